@@ -0,0 +1,75 @@
+package collator
+
+import (
+	"github.com/gilramir/monitor-weblog/xojoc/logparse"
+	"github.com/pkg/errors"
+	"xojoc.pw/useragent"
+)
+
+const (
+	// How many browsers, operating systems, and crawlers are sent in Sites
+	kTopAgents = 20
+
+	// How many different ones of each are counted
+	kMaxAgents = 1000
+
+	// With AlertOnHumans, how many entries without a user agent field, and
+	// none with one, show that the log format has none
+	kAgentlessEntries = 1000
+)
+
+// The kinds of user agents that the hits are split into
+const (
+	kHumanAgent = iota
+	kCrawlerAgent
+	kOtherAgent
+	kAgentKinds
+)
+
+// Find the kind of a user agent. Browsers are taken to be people; crawlers,
+// link checkers, validators, and feed readers are crawlers; and libraries,
+// the user agents that aren't known, and the entries without one, are
+// neither.
+func agentKind(agent *useragent.UserAgent) int {
+	if agent == nil {
+		return kOtherAgent
+	}
+	switch agent.Type {
+	case useragent.Browser:
+		return kHumanAgent
+	case useragent.Crawler, useragent.LinkChecker, useragent.Validator, useragent.FeedReader:
+		return kCrawlerAgent
+	default:
+		return kOtherAgent
+	}
+}
+
+// Count the browser and operating system, or the crawler, of a hit.
+func (self *Collator) countAgent(agent *useragent.UserAgent) {
+	switch agentKind(agent) {
+	case kHumanAgent:
+		countHit(self.browserHits, agent.Name, kMaxAgents)
+		countHit(self.osHits, agent.OS, kMaxAgents)
+	case kCrawlerAgent:
+		countHit(self.crawlerHits, agent.Name, kMaxAgents)
+	}
+}
+
+// With AlertOnHumans, make sure that the format of the log entries has the
+// user agent, as otherwise the alert could never fire. If the first
+// kAgentlessEntries entries have no user agent field, this is reported as an
+// error. An entry whose agent is "-", or is not one that is recognized, like
+// that of curl or of a health check, still has the field.
+func (self *Collator) checkAgent(entry *logparse.Entry) {
+	if !self.config.AlertOnHumans || self.agentsSeen {
+		return
+	}
+	if entry.HasUserAgent {
+		self.agentsSeen = true
+		return
+	}
+	self.agentlessEntries++
+	if self.agentlessEntries == kAgentlessEntries {
+		self.sendError(errors.Errorf("None of the first %d log entries has a user agent, so the alert on humans could never fire", kAgentlessEntries))
+	}
+}
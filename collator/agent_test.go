@@ -0,0 +1,115 @@
+package collator
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+func (s *MySuite) TestAgents(c *C) {
+	const (
+		firefox   = "Mozilla/5.0 (X11; Linux x86_64; rv:52.0) Gecko/20100101 Firefox/52.0"
+		googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		curl      = "curl/7.52.1"
+	)
+	line := func(agent string) string {
+		return `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326 "-" "` + agent + `"`
+	}
+
+	// Only the one person's hits count towards the alert
+	status, alerts, sites := replayLines(c, &Config{
+		AlertThreshold: 2,
+		AlertOnHumans:  true,
+		Format:         "combined",
+	}, line(firefox), line(googlebot), line(googlebot), line(googlebot), line(curl))
+	c.Check(alerts, HasLen, 0)
+	c.Assert(status, NotNil)
+	c.Check([]int{status.HumanHits, status.CrawlerHits, status.OtherAgentHits}, DeepEquals, []int{1, 3, 1})
+	c.Check(sites.Browsers, DeepEquals, []Count{{"Firefox", 1}})
+	c.Check(sites.OperatingSystems, DeepEquals, []Count{{"GNU/Linux", 1}})
+	c.Check(sites.Crawlers, DeepEquals, []Count{{"Googlebot", 3}})
+}
+
+func (s *MySuite) TestAlertOnHumansWithoutAgents(c *C) {
+	_, err := NewAndRun(context.Background(), &Config{
+		Filenames:     []string{filepath.Join(s.tmpDir, "access.log")},
+		Format:        "common",
+		AlertOnHumans: true,
+	})
+	c.Check(err, NotNil)
+
+	// A format that is not known to lack them is checked by its entries
+	filename := filepath.Join(s.tmpDir, "TestAlertOnHumansWithoutAgents.log")
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+	lines := make([]string, kAgentlessEntries)
+	for i := range lines {
+		lines[i] = `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	}
+	appendLines(c, filename, lines...)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filename},
+		AlertThreshold: 10,
+		AlertOnHumans:  true,
+		Format:         "apache",
+		LogFormat:      `%h %l %u %t "%r" %>s %b`,
+		Replay:         true,
+	})
+	c.Assert(err, IsNil)
+	_, err = getAlertWithTimeout(m, time.Duration(5)*time.Second)
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestAlertOnHumansWithUnknownAgents(c *C) {
+	// Health checks and scripts have agents which are not recognized, or
+	// none, but the format still has the field
+	agents := []string{
+		"curl/7.52.1",
+		"kube-probe/1.27",
+		"ELB-HealthChecker/2.0",
+		"Go-http-client/1.1",
+		"python-requests/2.31.0",
+		"-",
+	}
+	filename := filepath.Join(s.tmpDir, "TestAlertOnHumansWithUnknownAgents.log")
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+	lines := make([]string, kAgentlessEntries)
+	for i := range lines {
+		lines[i] = `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /health HTTP/1.1" 200 2 "-" "` + agents[i%len(agents)] + `"`
+	}
+	appendLines(c, filename, lines...)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filename},
+		AlertThreshold: 10,
+		AlertOnHumans:  true,
+		Format:         "combined",
+		Replay:         true,
+	})
+	c.Assert(err, IsNil)
+
+	// The Sites come once the replay has read every entry, after any error
+	timeout := time.After(5 * time.Second)
+	for sites := (*Sites)(nil); sites == nil; {
+		select {
+		case <-m.StatusChan:
+		case <-m.AlertChan:
+		case sites = <-m.SitesChan:
+		case err = <-m.ErrorChan:
+			c.Fatal(err)
+		case <-timeout:
+			c.Fatal("Timed out waiting for the replay to finish")
+		}
+	}
+	select {
+	case err = <-m.ErrorChan:
+		c.Fatal(err)
+	default:
+	}
+}
@@ -0,0 +1,209 @@
+package collator
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// How often to save the positions of the tailed files
+	kCheckpointDuration = 5 * time.Second
+)
+
+// How far a log file has been read. The device and the inode tell whether
+// the file was replaced (rotated) since the position was saved; they are 0
+// where they are not known.
+type position struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+
+	// The file, which is kept open so that the rest of it can be read once
+	// it is replaced or removed; nil if there was no file to open
+	file *os.File
+}
+
+// Read the positions saved in the state file. A missing state file has
+// no positions.
+func loadState(filename string) (map[string]*position, error) {
+	positions := make(map[string]*position)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return positions, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading the state file")
+	}
+	err = json.Unmarshal(data, &positions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading the state file %s", filename)
+	}
+	return positions, nil
+}
+
+// Write the positions to the state file. A temporary file is renamed over
+// it, so that a crash never leaves half a state file.
+func saveState(filename string, positions map[string]*position) error {
+	data, err := json.MarshalIndent(positions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return errors.Wrap(err, "Writing the state file")
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "Writing the state file")
+	}
+	return nil
+}
+
+// Decide where to start tailing a file, and start tracking its position.
+// A file is resumed from its saved position, unless it was rotated or
+// truncated since then, in which case it is read from its start. A file
+// with no saved position is read from its end, unless fromStart is set.
+func (self *Collator) startPosition(filename string, fromStart bool) (*position, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pos := &position{file: file}
+	pos.Device, pos.Inode = fileIdentity(info)
+
+	saved, has := self.savedPositions[filename]
+	switch {
+	case fromStart:
+		pos.Offset = 0
+	case !has:
+		pos.Offset = info.Size()
+	case saved.Device != pos.Device || saved.Inode != pos.Inode:
+		// Rotated; the lines written to the old file are not read
+		pos.Offset = 0
+	case saved.Offset > info.Size():
+		// Truncated
+		pos.Offset = 0
+	default:
+		pos.Offset = saved.Offset
+	}
+
+	self.positionsLock.Lock()
+	self.positions[filename] = pos
+	self.positionsLock.Unlock()
+	return pos, nil
+}
+
+// Note that a line of a file has been read. The file is checked each time:
+// while a file that was rotated is read to its end, the name is that of
+// another file, whose size says nothing, and a truncated file is read from
+// its start again, without the tail saying so.
+func (self *Collator) advancePosition(filename string, pos *position, text string) {
+	if pos.file == nil {
+		// It was reopened before the new file was created
+		self.reopenPosition(filename, pos)
+	}
+	// tail removes the newline
+	length := int64(len(text)) + 1
+	info, err := os.Stat(filename)
+
+	self.positionsLock.Lock()
+	defer self.positionsLock.Unlock()
+	if err == nil {
+		device, inode := fileIdentity(info)
+		if device == pos.Device && inode == pos.Inode && pos.Offset+length > info.Size() {
+			// Truncated
+			pos.Offset = 0
+		}
+	}
+	pos.Offset += length
+}
+
+// Note that the tail has read all of a file that was replaced (rotated), or
+// removed, and now reads the file that takes its name from its start. That
+// file may not have been created yet.
+func (self *Collator) reopenPosition(filename string, pos *position) {
+	pos.close()
+	var device, inode uint64
+	file, err := os.Open(filename)
+	if err == nil {
+		if info, err := file.Stat(); err == nil {
+			device, inode = fileIdentity(info)
+		}
+	}
+	self.positionsLock.Lock()
+	pos.Device, pos.Inode = device, inode
+	pos.Offset = 0
+	pos.file = file
+	self.positionsLock.Unlock()
+}
+
+// Stop tracking the position of a file, which is no longer tailed, and
+// return it, if it was tracked. Its file is still open.
+func (self *Collator) forgetPosition(filename string) *position {
+	self.positionsLock.Lock()
+	defer self.positionsLock.Unlock()
+	pos := self.positions[filename]
+	delete(self.positions, filename)
+	return pos
+}
+
+// Close the file of the position, if it has one.
+func (self *position) close() {
+	if self.file != nil {
+		self.file.Close()
+	}
+}
+
+// Save the positions regularly, and once more when the Collator stops.
+func (self *Collator) _checkpoint(ctx context.Context) {
+	defer close(self.stopped)
+
+	ticker := time.NewTicker(kCheckpointDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			self.stopErr = self.saveCheckpoint()
+			return
+		case <-ticker.C:
+			err := self.saveCheckpoint()
+			if err != nil {
+				self.sendError(err)
+				return
+			}
+		}
+	}
+}
+
+// Save the current positions to the state file.
+func (self *Collator) saveCheckpoint() error {
+	self.positionsLock.Lock()
+	positions := make(map[string]*position, len(self.positions))
+	for filename, pos := range self.positions {
+		// If the file was replaced, but the tail has not read all of the
+		// old one yet, this is the position in the old file, whose inode
+		// tells that the new file must be read from its start
+		positions[filename] = &position{Device: pos.Device, Inode: pos.Inode, Offset: pos.Offset}
+	}
+	self.positionsLock.Unlock()
+
+	return saveState(self.config.StateFile, positions)
+}
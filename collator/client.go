@@ -0,0 +1,59 @@
+package collator
+
+import (
+	"github.com/pkg/errors"
+	"net"
+)
+
+const (
+	// How many clients are sent in Sites
+	kTopClients = 20
+
+	// How many different clients are counted at once
+	kMaxClients = 10000
+
+	// The client of the entries that don't have one
+	kUnknownClient = "(unknown)"
+)
+
+// The client grouper finds the client of an entry: either its address, or
+// the subnet that its address is in, such as 203.0.113.0/24.
+type clientGrouper struct {
+	v4 net.IPMask
+	v6 net.IPMask
+}
+
+func newClientGrouper(config *Config) (*clientGrouper, error) {
+	v4, v6 := config.ClientPrefixV4, config.ClientPrefixV6
+	if v4 == 0 {
+		v4 = 8 * net.IPv4len
+	}
+	if v6 == 0 {
+		v6 = 8 * net.IPv6len
+	}
+	if v4 < 0 || v4 > 8*net.IPv4len {
+		return nil, errors.Errorf("The IPv4 client prefix must be from 1 to %d bits, not %d", 8*net.IPv4len, v4)
+	}
+	if v6 < 0 || v6 > 8*net.IPv6len {
+		return nil, errors.Errorf("The IPv6 client prefix must be from 1 to %d bits, not %d", 8*net.IPv6len, v6)
+	}
+	return &clientGrouper{
+		v4: net.CIDRMask(v4, 8*net.IPv4len),
+		v6: net.CIDRMask(v6, 8*net.IPv6len),
+	}, nil
+}
+
+// Find the client of an address.
+func (self *clientGrouper) group(ip net.IP) string {
+	mask := self.v6
+	if v4 := ip.To4(); v4 != nil {
+		ip, mask = v4, self.v4
+	} else if len(ip) != net.IPv6len {
+		return kUnknownClient
+	}
+	if ones, bits := mask.Size(); ones == bits {
+		return ip.String()
+	}
+	subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return subnet.String()
+}
@@ -0,0 +1,38 @@
+package collator
+
+import (
+	. "gopkg.in/check.v1"
+	"net"
+)
+
+func (s *MySuite) TestClientGrouper(c *C) {
+	addresses, err := newClientGrouper(&Config{})
+	c.Assert(err, IsNil)
+	subnets, err := newClientGrouper(&Config{ClientPrefixV4: 24, ClientPrefixV6: 64})
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		ip      net.IP
+		address string
+		subnet  string
+	}{
+		{net.ParseIP("203.0.113.57"), "203.0.113.57", "203.0.113.0/24"},
+		{net.ParseIP("2001:db8:1:2:3:4:5:6"), "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{nil, kUnknownClient, kUnknownClient},
+	}
+	for _, test := range tests {
+		c.Check(addresses.group(test.ip), Equals, test.address)
+		c.Check(subnets.group(test.ip), Equals, test.subnet)
+	}
+
+	_, err = newClientGrouper(&Config{ClientPrefixV4: 33})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestCountHit(c *C) {
+	hits := make(map[string]int)
+	for _, name := range []string{"a", "b", "a", "c", "d"} {
+		countHit(hits, name, 2)
+	}
+	c.Check(hits, DeepEquals, map[string]int{"a": 2, "b": 1, kOther: 2})
+}
@@ -1,15 +1,17 @@
 package collator
 
-// The Collator watches a log file in the Common Log format and sends data
-// to a listener.
+// The Collator watches log files in the formats known to logparse and sends
+// data to a listener.
 
 import (
 	"context"
+	"fmt"
 	"github.com/RobinUS2/golang-moving-average"
 	"github.com/gilramir/monitor-weblog/xojoc/logparse"
-	"github.com/hpcloud/tail"
+	"github.com/pkg/errors"
+	"net"
 	"sort"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,32 +23,268 @@ const (
 	// how often to check to see if we need to send an alert. This is also
 	// used to send Status objects.
 	kMovingAverageTimerDuration = 1 * time.Second
+
+	// How many of the most recent bad lines are kept to report in Status
+	kRecentBadLines = 5
+
+	// The number of HTTP status classes that are counted: 2xx to 5xx
+	kStatusClasses = 4
+
+	// The name under which the hits on anything are counted together,
+	// once too many different things have been counted
+	kOther = "(other)"
 )
 
+// The Config holds the settings that the Collator runs with.
+type Config struct {
+	// The log files to monitor; these can be glob patterns, "-" for the
+	// standard input, syslog://ADDRESS to listen for syslog messages, over
+	// UDP and TCP, on a local address, or http://ADDRESS[/PATH] to accept
+	// log lines POSTed to a local address
+	Filenames []string
+
+	// If set, the directories of the Filenames are watched, so that log
+	// files which match them are tailed as they are created, and are no
+	// longer tailed when they are removed
+	Watch bool
+
+	// The number of hits per second, over a 2-minute average, at which to alert
+	AlertThreshold int
+
+	// If set, alerts are also sent for each log file, instead of only for
+	// all of them together
+	AlertPerSource bool
+
+	// The name of the log format (see logparse.Formats), or "auto" to
+	// detect it from the first lines of each file; "auto" if not set.
+	// It can also be "apache" or "nginx", for a custom Apache LogFormat
+	// or nginx log_format.
+	Format string
+
+	// The LogFormat string for the "apache" format, the log_format
+	// (either the format string or the whole directive) for "nginx", or
+	// the field mapping (see logparse.ParseJSONMapping) for "json"
+	LogFormat string
+
+	// If set, lines that cannot be parsed are counted and reported in
+	// Status, instead of stopping the Collator
+	Tolerant bool
+
+	// In tolerant mode, stop if more than this percentage of recent lines
+	// cannot be parsed; 0 means there is no limit
+	MaxErrorPercent int
+
+	// If set, the log files are read from their start, instead of being
+	// tailed, and time is advanced by the times of their entries, instead
+	// of by the wall clock. As the clock only moves forward, a replay reads
+	// one log file, after any Rotated ones. This cannot be used with Watch.
+	Replay bool
+
+	// How many times faster than real time to replay; 0 means as fast as
+	// possible
+	ReplaySpeed int
+
+	// If set, hits are counted in the second given by the time of their
+	// entry, instead of the second in which they are read. This cannot be
+	// used with Replay, which already does so.
+	EventTime bool
+
+	// With EventTime, how long to wait for the entries of a second before
+	// counting them; entries that come later than this, or whose time is
+	// further than this in the future, are only counted in
+	// Status.LateEntries
+	AllowedLateness time.Duration
+
+	// Rules which name the section of a request's path, which its hit is
+	// counted in; see parseSectionRule. The rules are tried in order.
+	SectionRules []string
+
+	// How many segments of a path that no rule matches make its section;
+	// 1 if not set, so that /a/b is in the section /a
+	SectionDepth int
+
+	// The section of the paths that no rule matches, and that have no more
+	// segments than SectionDepth, such as / or /favicon.ico; "/" if not set
+	RootSection string
+
+	// Patterns for the segments of paths which are identifiers, of the
+	// form REGEXP=NAME; the segments which match REGEXP are replaced by
+	// NAME in the routes, as well as numbers, UUIDs, dates, and hashes
+	RoutePatterns []string
+
+	// Alert when more than this percentage of the hits over the
+	// ErrorRateWindow had a server error (5xx) status; 0 for no alert
+	ServerErrorPercent int
+
+	// Alert when more than this percentage of the hits over the
+	// ErrorRateWindow had a client error (4xx) status; 0 for no alert
+	ClientErrorPercent int
+
+	// How long the error rates are measured over; a minute if not set
+	ErrorRateWindow time.Duration
+
+	// The error rates are not alerted on while there are fewer hits than
+	// this in the window, so that quiet periods don't alert, and an alert
+	// recovers when the hits drop below it; 100 if not set
+	ErrorRateMinHits int
+
+	// Alert when the 2-minute moving average of the bytes sent per second
+	// is above this; 0 for no alert
+	BandwidthThreshold int64
+
+	// The clients are grouped into subnets with these prefix lengths, such
+	// as 24 for IPv4 and 64 for IPv6; if not set, each address is a client
+	ClientPrefixV4 int
+	ClientPrefixV6 int
+
+	// Alert on the hits of browsers only, so that crawlers and scripts
+	// don't set off the alert. The log format must have the user agent;
+	// this cannot be used with the common format, and if none of the first
+	// entries has a user agent field, an error is sent to the ErrorChan.
+	AlertOnHumans bool
+
+	// Alert when the 99th percentile of the latency of the requests is
+	// above this for every second of the LatencyWindow that has requests,
+	// and recover when it is no longer above it for as long; 0 for no alert
+	LatencyThreshold time.Duration
+
+	// How long the latency must stay above or below the threshold; 30
+	// seconds if not set
+	LatencyWindow time.Duration
+
+	// Our own domains, whose pages are not counted as referrers, and
+	// neither are those of their subdomains
+	InternalDomains []string
+
+	// Older log files, such as those rotated by logrotate, to replay before
+	// the Filenames, which are then read from their start. These can be
+	// glob patterns, and the files can be compressed with gzip. They are
+	// read oldest first. Without Replay, they and the log file are
+	// replayed as fast as possible, and then the log file is tailed from
+	// where the replay stopped; as with Replay, there can only be one log
+	// file, and this cannot be used with Watch, EventTime, or StateFile.
+	Rotated []string
+
+	// If set, how far each log file has been read is saved to this file
+	// regularly and when the Collator stops, and the log files are resumed
+	// from there when it starts again. This cannot be used with Replay, or
+	// with Rotated.
+	StateFile string
+}
+
 // An Alert notifies the listener of high traffic, and also when traffic
 // returns to a normal level
 type Alert struct {
 	InAlertState         bool
 	AverageHitsPerSecond float64
 	Time                 time.Time
+	// The log file whose traffic changed, or empty for all of them together
+	Source string
+	// The name of the rule that was broken or recovered, such as "hits"
+	// or "5xx-rate", and what it found
+	Rule   string
+	Reason string
 }
 
 // The Sites object lists the # of hits per site, and are sent less often
 // (every 10 seconds)
 type Sites struct {
+	// The sites in all of the logs together
 	Sites []Site
+	// The sites in each log file
+	BySource map[string][]Site
+	// The routes with the most hits, in all of the logs together
+	Routes []Count
+	// The clients with the most hits, in all of the logs together; each is
+	// an address, or a subnet if the addresses are grouped. As only so many
+	// clients are counted, the hits of a client that first came after the
+	// others can include some of those of the client it replaced.
+	Clients []Count
+	// The browsers, and their operating systems, and the crawlers with the
+	// most hits, in all of the logs together
+	Browsers         []Count
+	OperatingSystems []Count
+	Crawlers         []Count
+	// The domains that referred the most hits, in all of the logs
+	// together, other than the internal ones; they are counted like the
+	// clients
+	Referrers []Count
 }
 
 type Site struct {
 	TotalHits int
 	Site      string
+	// The hits with a server error (5xx) status, and their share of the hits
+	Errors    int
+	ErrorRate float64
+	// The bytes sent in the responses
+	Bytes int64
+	// The latency of the requests, if the log format has their durations,
+	// over the same time as the hits: since the start, or the last reset,
+	// instead of the last second. Only the first 100 sites to have a
+	// duration have their latency counted.
+	Latency Latency
+}
+
+// A Count is the number of hits on something, such as a route
+type Count struct {
+	Name string
+	Hits int
+}
+
+// A BadLine is a line from the log that could not be parsed
+type BadLine struct {
+	// The log file the line came from
+	Source string
+	// The line number, counting from where the Collator started reading
+	LineNumber int
+	// The column at which parsing stopped, or 0 if not known
+	Column int
+	Err    error
 }
 
 // These Status objects are sent frequently (one per second)
 type Status struct {
 	HitsLastSecond       int
 	AverageHitsPerSecond float64
-	// Additional information could be added here in the future
+
+	// The hits in each log file
+	BySource map[string]SourceStatus
+
+	// The number of lines that could not be parsed, and the most recent of them
+	BadLines       int
+	RecentBadLines []BadLine
+
+	// With event time, the number of entries that came too late to be
+	// counted, or whose time was too far in the future
+	LateEntries int
+
+	// The hits of the last second by the class of their HTTP status
+	Hits2xx int
+	Hits3xx int
+	Hits4xx int
+	Hits5xx int
+
+	// The bytes sent in the responses of the last second, and their
+	// 2-minute moving average
+	BytesLastSecond       int64
+	AverageBytesPerSecond float64
+
+	// The hits of the last second by their user agent: browsers, crawlers,
+	// and everything else, such as scripts and unknown user agents
+	HumanHits      int
+	CrawlerHits    int
+	OtherAgentHits int
+
+	// The latency of the requests of the last second, if the log format
+	// has their durations
+	Latency Latency
+}
+
+// The part of a Status for a single log file
+type SourceStatus struct {
+	HitsLastSecond       int
+	AverageHitsPerSecond float64
 }
 
 // ByHits implements sort.Interface for []SizeHite, based on the number of hits
@@ -57,64 +295,308 @@ func (a ByHits) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByHits) Less(i, j int) bool { return a[i].TotalHits < a[j].TotalHits }
 
 type Collator struct {
+	// The ErrorChan is never closed, as the tails, the watchers and the
+	// listeners can send errors to it until they stop
 	ErrorChan  chan error
 	SitesChan  chan *Sites
 	StatusChan chan *Status
 	AlertChan  chan *Alert
 	ResetChan  chan bool
 
+	config         *Config
 	alertThreshold float64
-	tailer         *tail.Tail
+	parsers        map[string]logparse.Parser
+	badLineChan    chan *BadLine
 
-	accumHits          int
-	inAlertedState     bool
 	sitesTimer         *time.Timer
 	movingAverageTimer *time.Timer
+	sections           *sectionRules
+	routes             *routeNormalizer
+	routeHits          map[string]int
+	clients            *clientGrouper
+	clientHits         *heavyHitters
+	browserHits        map[string]int
+	osHits             map[string]int
+	crawlerHits        map[string]int
+	referrerHits       *heavyHitters
+	internalDomains    []string
+	replayClock        *replayClock
+	eventBuckets       *eventBuckets
+
+	// The addresses that the listeners are bound to, by their log name,
+	// which tells which port was chosen for a port of 0
+	listenAddrs map[string]net.Addr
+
+	// The positions read from the state file, and the current positions
+	// of the tailed files, which the tails update
+	savedPositions map[string]*position
+	positions      map[string]*position
+	positionsLock  sync.Mutex
+
+	// Closed when the Collator has stopped, with the error from saving
+	// its state, if any
+	stopped chan struct{}
+	stopErr error
+
+	// The counters for all of the logs together, and for each log
+	total   *counters
+	sources map[string]*counters
+
+	badLines       int
+	recentBadLines []BadLine
+
+	// With AlertOnHumans, whether an entry has had a user agent field, and
+	// how many entries have come without one before that
+	agentsSeen       bool
+	agentlessEntries int
+}
+
+// The counters kept for a set of logs
+type counters struct {
+	accumHits          int
+	accumClasses       [kStatusClasses]int
+	accumBytes         int64
+	accumAgents        [kAgentKinds]int
+	accumLatency       *latencySketch
+	inAlertedState     bool
 	hitsMovingAverage  *movingaverage.MovingAverage
+	bytesMovingAverage *movingaverage.MovingAverage
+	humanMovingAverage *movingaverage.MovingAverage
+	sites              map[string]*siteCounts
+	latencySites       int
+
+	// The alert rules, and which of them are broken
+	rules       []alertRule
+	rulesBroken []bool
+}
 
-	siteHits map[string]int
+// The hits of one site
+type siteCounts struct {
+	hits   int
+	errors int
+	bytes  int64
+	// Only made once a request has a duration, for the first
+	// kMaxLatencySites sites to have one
+	latency *latencySketch
+}
+
+func (self *Collator) newCounters() *counters {
+	rules := self.newRules()
+	return &counters{
+		hitsMovingAverage:  movingaverage.New(2 * 60), // 2 minutes, with 1-second windows
+		bytesMovingAverage: movingaverage.New(2 * 60),
+		humanMovingAverage: movingaverage.New(2 * 60),
+		accumLatency:       newLatencySketch(),
+		sites:              make(map[string]*siteCounts),
+		rules:              rules,
+		rulesBroken:        make([]bool, len(rules)),
+	}
 }
 
 // Create a new Collator and start running its goroutines. The caller can
 // stop the Collator by calling the CancelFunc in the passed-in context.
-func NewAndRun(ctx context.Context, filename string, alertThreshold int) (*Collator, error) {
+func NewAndRun(ctx context.Context, config *Config) (*Collator, error) {
+	// Rotated logs are replayed, with the log, before it is tailed
+	replay := config.Replay || len(config.Rotated) > 0
+	if replay && config.Watch {
+		return nil, errors.New("A replay cannot watch for new log files")
+	}
+	if replay && config.EventTime {
+		return nil, errors.New("A replay already counts hits by the time of their entries")
+	}
+	if config.Watch {
+		for _, pattern := range config.Filenames {
+			if !isFile(pattern) {
+				return nil, errors.Errorf("%s cannot be watched for", pattern)
+			}
+		}
+	}
+	if replay && config.StateFile != "" {
+		return nil, errors.New("A replay always reads the log files from their start")
+	}
+	if config.AlertOnHumans && config.Format == "common" {
+		return nil, errors.New("The common log format has no user agent, so the alert on humans could never fire")
+	}
+
+	// Check the format first, so that a bad format is reported before
+	// anything starts. Each log gets its own parser once it is read.
+	if config.Format != "" && config.Format != kAutoFormat {
+		_, err := newParser(config, "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	c := &Collator{
-		ErrorChan:         make(chan error, 1), // buffered so anyone can write an error at any time
-		SitesChan:         make(chan *Sites),
-		AlertChan:         make(chan *Alert),
-		StatusChan:        make(chan *Status),
-		ResetChan:         make(chan bool),
-		siteHits:          make(map[string]int),
-		hitsMovingAverage: movingaverage.New(2 * 60), // 2 minutes, with 1-second windows
-		alertThreshold:    float64(alertThreshold),
-	}
-
-	// Tail the log
-	lineChan := make(chan string)
-	err := c.startTail(ctx, filename, lineChan)
+		ErrorChan:      make(chan error, 1), // buffered so anyone can write an error at any time
+		SitesChan:      make(chan *Sites),
+		AlertChan:      make(chan *Alert),
+		StatusChan:     make(chan *Status),
+		ResetChan:      make(chan bool),
+		config:         config,
+		alertThreshold: float64(config.AlertThreshold),
+		parsers:        make(map[string]logparse.Parser),
+		badLineChan:    make(chan *BadLine),
+		sources:        make(map[string]*counters),
+		routeHits:      make(map[string]int),
+		clientHits:     newHeavyHitters(kMaxClients),
+		browserHits:    make(map[string]int),
+		osHits:         make(map[string]int),
+		crawlerHits:    make(map[string]int),
+		referrerHits:   newHeavyHitters(kMaxReferrers),
+		positions:      make(map[string]*position),
+		listenAddrs:    make(map[string]net.Addr),
+		stopped:        make(chan struct{}),
+	}
+
+	c.total = c.newCounters()
+
+	// How the hits are grouped into sections
+	var err error
+	c.sections, err = newSectionRules(config)
 	if err != nil {
 		return nil, err
 	}
+	c.routes, err = newRouteNormalizer(config.RoutePatterns)
+	if err != nil {
+		return nil, err
+	}
+	c.clients, err = newClientGrouper(config)
+	if err != nil {
+		return nil, err
+	}
+	c.internalDomains = internalDomains(config.InternalDomains)
+
+	// Where to resume the logs from
+	if config.StateFile != "" {
+		c.savedPositions, err = loadState(config.StateFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Replay {
+		c.replayClock = newReplayClock(config.ReplaySpeed)
+	} else if len(config.Rotated) > 0 {
+		// Until the log is tailed, the logs are replayed as fast as possible
+		c.replayClock = newReplayClock(0)
+	}
+
+	// Find the logs; watched logs are found once they are watched
+	var filenames []string
+	if !config.Watch {
+		filenames, err = expandFilenames(config.Filenames, false)
+		if err != nil {
+			return nil, err
+		}
+		if replay && len(filenames) > 1 {
+			// Their entries would not be in the order of their times
+			return nil, errors.Errorf("A replay reads one log file, not %d", len(filenames))
+		}
+		if len(config.Rotated) > 0 && !config.Replay && len(filenames) == 1 && (!isFile(filenames[0]) || isNamedPipe(filenames[0])) {
+			// It could not be tailed from where the replay stopped
+			return nil, errors.Errorf("Rotated log files cannot be read before %s", filenames[0])
+		}
+		for _, filename := range filenames {
+			// A listener's sources are the senders of its messages
+			if !isListener(filename) {
+				c.sources[filename] = c.newCounters()
+			}
+		}
+	}
+
+	// Tail the logs, once any rotated logs have been read
+	lineChan := make(chan *logLine)
+	if len(config.Rotated) > 0 {
+		rotated, err := expandRotated(config.Rotated)
+		if err != nil {
+			return nil, err
+		}
+		go c._catchUp(ctx, rotated, filenames, lineChan)
+	} else {
+		err := c.startLogs(ctx, filenames, false, lineChan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.EventTime {
+		c.eventBuckets = newEventBuckets(config.AllowedLateness, time.Now())
+	}
 
 	// Parse each line
-	entryChan := make(chan *logparse.Entry)
+	entryChan := make(chan *record)
 	go c._parse(ctx, lineChan, entryChan)
 
 	// And monitor the information
 	go c._collate(ctx, entryChan)
 
+	// And save how far the logs have been read
+	if config.StateFile != "" {
+		go c._checkpoint(ctx)
+	} else {
+		close(c.stopped)
+	}
+
 	return c, nil
 }
 
-func (self *Collator) _collate(ctx context.Context, entryChan <-chan *logparse.Entry) {
-	defer self.tailer.Stop() // this will ignore a possible error, but that's ok
-	defer close(self.ErrorChan)
+// Wait for the Collator to stop, once its context is done, and return any
+// error from saving its state.
+func (self *Collator) Wait() error {
+	<-self.stopped
+	return self.stopErr
+}
+
+// Start tailing the logs, or watching for them. If fromStart is set, the
+// logs that exist now are read from their start.
+func (self *Collator) startLogs(ctx context.Context, filenames []string, fromStart bool, lineChan chan<- *logLine) error {
+	if self.config.Watch {
+		return self.startWatch(ctx, self.config.Filenames, fromStart, lineChan)
+	}
+
+	var dones []<-chan struct{}
+	for _, filename := range filenames {
+		done, err := self.startTail(ctx, filename, fromStart, lineChan)
+		if err != nil {
+			return err
+		}
+		dones = append(dones, done)
+	}
+	if self.config.Replay {
+		// A replay ends when all the logs have been read
+		go _closeWhenDone(dones, lineChan)
+	}
+	return nil
+}
+
+// Close the channel of lines once all the tails have stopped
+func _closeWhenDone(dones []<-chan struct{}, lineChan chan<- *logLine) {
+	for _, done := range dones {
+		<-done
+	}
+	close(lineChan)
+}
+
+// Notify the listener of an error. The listener stops at the first error,
+// so only the first one is kept, and nobody waits for a later one to be read.
+func (self *Collator) sendError(err error) {
+	select {
+	case self.ErrorChan <- err:
+	default:
+	}
+}
+
+func (self *Collator) _collate(ctx context.Context, entryChan <-chan *record) {
 	defer close(self.SitesChan)
 	defer close(self.AlertChan)
 	defer close(self.StatusChan)
 
-	self.sitesTimer = time.NewTimer(kSitesTimerDuration)
-	self.movingAverageTimer = time.NewTimer(kMovingAverageTimerDuration)
+	// The timers are not used in a replay, which is driven by the
+	// times of the log entries
+	var movingAverageTimerChan, sitesTimerChan <-chan time.Time
+	if self.replayClock == nil {
+		movingAverageTimerChan, sitesTimerChan = self.startTimers()
+	}
 
 	for {
 		select {
@@ -122,90 +604,319 @@ func (self *Collator) _collate(ctx context.Context, entryChan <-chan *logparse.E
 		case <-ctx.Done():
 			return
 
-		// A log entry
-		case entry := <-entryChan:
-			self.recordEntry(entry)
-			self.accumHits++
-
-		// Moving Average timer
-		case now := <-self.movingAverageTimer.C:
-			// Calculate the 2-minute moving average
-			self.hitsMovingAverage.Add(float64(self.accumHits))
-			avg := self.hitsMovingAverage.Avg()
-
-			// Send the per-second status
-			self.StatusChan <- &Status{
-				HitsLastSecond:       self.accumHits,
-				AverageHitsPerSecond: avg,
+		// A log entry, or the end of a log
+		case record, ok := <-entryChan:
+			if !ok {
+				// The parsing stopped, either at the end of a replay or
+				// because of an error; keep the results until we are stopped
+				if self.replayClock != nil {
+					self.finishReplay()
+				}
+				entryChan = nil
+				continue
+			}
+			if record.caughtUp {
+				// The rotated logs, and the log, have been replayed; from
+				// now on, the log is tailed, by the wall clock
+				self.finishReplay()
+				self.replayClock = nil
+				movingAverageTimerChan, sitesTimerChan = self.startTimers()
+				continue
 			}
+			if self.eventBuckets != nil {
+				// Held until its second is counted
+				self.eventBuckets.add(record, time.Now())
+				continue
+			}
+			now := time.Now()
+			if self.replayClock != nil {
+				if !record.closed && !self.advanceReplay(ctx, record.entry.Time) {
+					return
+				}
+				now = self.replayClock.nextTick
+			}
+			self.applyRecord(record, now)
 
-			self.accumHits = 0
+		// A line that could not be parsed
+		case badLine := <-self.badLineChan:
+			self.recordBadLine(badLine)
 
-			// Need to alert?
-			if self.inAlertedState {
-				if avg < self.alertThreshold {
-					self.AlertChan <- &Alert{false, avg, now}
-					self.inAlertedState = false
-				}
+		// Moving Average timer
+		case now := <-movingAverageTimerChan:
+			if self.eventBuckets != nil {
+				self.closeEventBuckets(now)
 			} else {
-				if avg > self.alertThreshold {
-					self.AlertChan <- &Alert{true, avg, now}
-					self.inAlertedState = true
-				}
+				self.tick(now)
 			}
-
 			self.movingAverageTimer.Reset(kMovingAverageTimerDuration)
 
 		// Sitest timer
-		case <-self.sitesTimer.C:
+		case <-sitesTimerChan:
 			self.sendSites()
 			self.sitesTimer.Reset(kSitesTimerDuration)
 
 		// User requests a reset of counters
 		case <-self.ResetChan:
-			self.siteHits = make(map[string]int)
+			self.routeHits = make(map[string]int)
+			self.clientHits = newHeavyHitters(kMaxClients)
+			self.browserHits = make(map[string]int)
+			self.osHits = make(map[string]int)
+			self.crawlerHits = make(map[string]int)
+			self.referrerHits = newHeavyHitters(kMaxReferrers)
+			self.total.sites = make(map[string]*siteCounts)
+			self.total.latencySites = 0
+			for _, source := range self.sources {
+				source.sites = make(map[string]*siteCounts)
+				source.latencySites = 0
+			}
+		}
+	}
+}
+
+// Start the timers which send the Status and the Sites by the wall clock,
+// and return their channels.
+func (self *Collator) startTimers() (<-chan time.Time, <-chan time.Time) {
+	self.sitesTimer = time.NewTimer(kSitesTimerDuration)
+	self.movingAverageTimer = time.NewTimer(kMovingAverageTimerDuration)
+	return self.movingAverageTimer.C, self.sitesTimer.C
+}
 
+// Once a second, calculate the moving averages, send the Status, and check
+// whether we need to alert.
+func (self *Collator) tick(now time.Time) {
+	status := &Status{
+		BySource:       make(map[string]SourceStatus),
+		BadLines:       self.badLines,
+		RecentBadLines: append([]BadLine(nil), self.recentBadLines...),
+	}
+	if self.eventBuckets != nil {
+		status.LateEntries = self.eventBuckets.late
+	}
+
+	total := self.total.tick()
+	status.HitsLastSecond, status.AverageHitsPerSecond = total.hits, total.average
+	status.Hits2xx, status.Hits3xx, status.Hits4xx, status.Hits5xx =
+		total.classes[0], total.classes[1], total.classes[2], total.classes[3]
+	status.BytesLastSecond, status.AverageBytesPerSecond = total.bytes, total.averageBytes
+	status.HumanHits, status.CrawlerHits, status.OtherAgentHits =
+		total.agents[kHumanAgent], total.agents[kCrawlerAgent], total.agents[kOtherAgent]
+	status.Latency = total.latency
+	sourceSeconds := make(map[string]*second, len(self.sources))
+	for name, source := range self.sources {
+		s := source.tick()
+		sourceSeconds[name] = s
+		status.BySource[name] = SourceStatus{
+			HitsLastSecond:       s.hits,
+			AverageHitsPerSecond: s.average,
+		}
+	}
+
+	// Send the per-second status
+	self.StatusChan <- status
+
+	// Need to alert?
+	self.checkAlert(now, "", self.total)
+	self.checkRules(now, "", self.total, total)
+	if self.config.AlertPerSource {
+		for name, source := range self.sources {
+			self.checkAlert(now, name, source)
+			self.checkRules(now, name, source, sourceSeconds[name])
 		}
 	}
 }
 
-// Given a single log entry, record any useful info from it.
-func (self *Collator) recordEntry(entry *logparse.Entry) {
+// Add the hits, human hits, and bytes of the last second to their 2-minute
+// moving averages, and return the counts of the last second.
+func (self *counters) tick() *second {
+	s := &second{
+		hits:    self.accumHits,
+		classes: self.accumClasses,
+		bytes:   self.accumBytes,
+		agents:  self.accumAgents,
+		latency: self.accumLatency.latency(),
+	}
+	self.humanMovingAverage.Add(float64(s.agents[kHumanAgent]))
+	self.hitsMovingAverage.Add(float64(s.hits))
+	s.average = self.hitsMovingAverage.Avg()
+	self.bytesMovingAverage.Add(float64(s.bytes))
+	s.averageBytes = self.bytesMovingAverage.Avg()
+	self.accumHits = 0
+	self.accumClasses = [kStatusClasses]int{}
+	self.accumBytes = 0
+	self.accumAgents = [kAgentKinds]int{}
+	self.accumLatency.reset()
+	return s
+}
 
-	// Sanity check
-	if len(entry.Request.URL.Path) < 3 || entry.Request.URL.Path[0] != '/' {
+// Send an alert if the moving average crossed the threshold.
+func (self *Collator) checkAlert(now time.Time, source string, c *counters) {
+	avg, hits := c.hitsMovingAverage.Avg(), "hits"
+	if self.config.AlertOnHumans {
+		avg, hits = c.humanMovingAverage.Avg(), "human hits"
+	}
+	reason := fmt.Sprintf("%.1f %s/s over 2 minutes", avg, hits)
+	if c.inAlertedState {
+		if avg < self.alertThreshold {
+			self.AlertChan <- &Alert{false, avg, now, source, kHitsRule, reason}
+			c.inAlertedState = false
+		}
+	} else {
+		if avg > self.alertThreshold {
+			self.AlertChan <- &Alert{true, avg, now, source, kHitsRule, reason}
+			c.inAlertedState = true
+		}
+	}
+}
+
+// Record a log entry, or forget a log that has ended, once any alerts on
+// it have recovered.
+func (self *Collator) applyRecord(record *record, now time.Time) {
+	if record.closed {
+		if c, has := self.sources[record.source]; has {
+			self.recoverAlerts(now, record.source, c)
+		}
+		delete(self.sources, record.source)
 		return
 	}
+	self.recordEntry(record.source, record.entry)
+}
 
-	secondSlashIndex := strings.Index(entry.Request.URL.Path[1:], "/")
-	if secondSlashIndex == -1 {
-		// Not present
+// Given a single log entry, record any useful info from it.
+func (self *Collator) recordEntry(source string, entry *logparse.Entry) {
+	sourceCounters, has := self.sources[source]
+	if !has {
+		sourceCounters = self.newCounters()
+		self.sources[source] = sourceCounters
+	}
+	self.total.accumHits++
+	sourceCounters.accumHits++
+	self.total.accumBytes += int64(entry.Bytes)
+	sourceCounters.accumBytes += int64(entry.Bytes)
+	kind := agentKind(entry.UserAgent)
+	self.total.accumAgents[kind]++
+	sourceCounters.accumAgents[kind]++
+	self.countAgent(entry.UserAgent)
+	self.checkAgent(entry)
+	self.countReferrer(entry.Referer)
+	if entry.Duration >= 0 {
+		self.total.accumLatency.add(entry.Duration)
+		sourceCounters.accumLatency.add(entry.Duration)
+	}
+	if class, ok := statusClass(entry.Status); ok {
+		self.total.accumClasses[class]++
+		sourceCounters.accumClasses[class]++
+	}
+
+	self.clientHits.add(self.clients.group(entry.Host))
+
+	// Sanity check
+	if entry.Request == nil {
 		return
 	}
-	// Add 1 to the index because the Index() call was made on a substring starting at position 1
-	site := entry.Request.URL.Path[:secondSlashIndex+1]
+	site := self.sections.find(entry.Request.URL.Path)
+	for _, c := range []*counters{self.total, sourceCounters} {
+		counts, has := c.sites[site]
+		if !has {
+			counts = &siteCounts{}
+			c.sites[site] = counts
+		}
+		counts.hits++
+		if entry.Status/100 == 5 {
+			counts.errors++
+		}
+		counts.bytes += int64(entry.Bytes)
+		if entry.Duration >= 0 {
+			if counts.latency == nil && c.latencySites < kMaxLatencySites {
+				counts.latency = newLatencySketch()
+				c.latencySites++
+			}
+			if counts.latency != nil {
+				counts.latency.add(entry.Duration)
+			}
+		}
+	}
 
-	_, has := self.siteHits[site]
-	if has {
-		self.siteHits[site]++
-	} else {
-		self.siteHits[site] = 1
+	countHit(self.routeHits, self.routes.normalize(entry.Request.URL.Path), kMaxRoutes)
+}
+
+// Count a line that could not be parsed, and remember the most recent ones.
+func (self *Collator) recordBadLine(badLine *BadLine) {
+	self.badLines++
+	self.recentBadLines = append(self.recentBadLines, *badLine)
+	if len(self.recentBadLines) > kRecentBadLines {
+		self.recentBadLines = self.recentBadLines[1:]
 	}
 }
 
-// Send a Hit struct to the client
+// Send a Sites struct to the client
 func (self *Collator) sendSites() {
-	// Create the slice of Site's
-	sites := make([]Site, len(self.siteHits))
+	bySource := make(map[string][]Site)
+	for name, source := range self.sources {
+		bySource[name] = sortedSites(source.sites)
+	}
+	self.SitesChan <- &Sites{
+		Sites:    sortedSites(self.total.sites),
+		BySource: bySource,
+		Routes:   topCounts(self.routeHits, kTopRoutes),
+		Clients:  self.clientHits.top(kTopClients),
+
+		Browsers:         topCounts(self.browserHits, kTopAgents),
+		OperatingSystems: topCounts(self.osHits, kTopAgents),
+		Crawlers:         topCounts(self.crawlerHits, kTopAgents),
+		Referrers:        self.referrerHits.top(kTopReferrers),
+	}
+}
+
+// Create the slice of Site's, sorted by number of hits
+func sortedSites(siteCounts map[string]*siteCounts) []Site {
+	sites := make([]Site, len(siteCounts))
 	i := 0
-	for site, totalHits := range self.siteHits {
+	for site, counts := range siteCounts {
 		sites[i].Site = site
-		sites[i].TotalHits = totalHits
+		sites[i].TotalHits = counts.hits
+		sites[i].Errors = counts.errors
+		sites[i].ErrorRate = float64(counts.errors) / float64(counts.hits)
+		sites[i].Bytes = counts.bytes
+		if counts.latency != nil {
+			sites[i].Latency = counts.latency.latency()
+		}
 		i++
 	}
 	// Reverse sort them by number of hits per site
 	sort.Sort(sort.Reverse(ByHits(sites)))
-	self.SitesChan <- &Sites{
-		Sites: sites,
+	return sites
+}
+
+// The index of the class of an HTTP status, if it is one that is counted
+func statusClass(status int) (int, bool) {
+	class := status/100 - 2
+	return class, class >= 0 && class < kStatusClasses
+}
+
+// Count a hit on a name. Once there are max names, the hits on any new ones
+// are counted together as kOther.
+func countHit(hits map[string]int, name string, max int) {
+	if _, has := hits[name]; !has && len(hits) >= max {
+		name = kOther
+	}
+	hits[name]++
+}
+
+// Find the names with the most hits, sorted by their number of hits, and
+// then by name
+func topCounts(hits map[string]int, n int) []Count {
+	counts := make([]Count, 0, len(hits))
+	for name, count := range hits {
+		counts = append(counts, Count{name, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Hits != counts[j].Hits {
+			return counts[i].Hits > counts[j].Hits
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
 	}
+	return counts
 }
@@ -1,11 +1,16 @@
 package collator
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
 	. "gopkg.in/check.v1"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
@@ -17,16 +22,16 @@ func (s *MySuite) TestAlert(c *C) {
 
 	// Start a collator
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	m, err := NewAndRun(ctx, tmpFile, 10)
+	m, err := NewAndRun(ctx, &Config{Filenames: []string{tmpFile}, AlertThreshold: 10})
 	c.Assert(err, IsNil)
 	defer cancelFunc()
 
 	// Add some big hit counts; we could be Add-ing while the
 	// _collate go-routine is also Add-ing, but it's safe enough not
 	// to worry about, and anyway, we're faster than the 1-second timer
-	m.hitsMovingAverage.Add(20.0)
-	m.hitsMovingAverage.Add(20.0)
-	m.hitsMovingAverage.Add(20.0)
+	m.total.hitsMovingAverage.Add(20.0)
+	m.total.hitsMovingAverage.Add(20.0)
+	m.total.hitsMovingAverage.Add(20.0)
 
 	// Expect an alert
 	alert, err := getAlertWithTimeout(m, time.Duration(30)*time.Second)
@@ -38,7 +43,7 @@ func (s *MySuite) TestAlert(c *C) {
 
 	// Expect the recovery from an alert
 	// Add one zero, first, to reduce the moving average
-	m.hitsMovingAverage.Add(0.0)
+	m.total.hitsMovingAverage.Add(0.0)
 	alert, err = getAlertWithTimeout(m, time.Duration(30)*time.Second)
 
 	// Stop the Collator
@@ -59,16 +64,16 @@ func (s *MySuite) TestNoAlert(c *C) {
 
 	// Start a collator
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	m, err := NewAndRun(ctx, tmpFile, 10)
+	m, err := NewAndRun(ctx, &Config{Filenames: []string{tmpFile}, AlertThreshold: 10})
 	c.Assert(err, IsNil)
 	defer cancelFunc()
 
 	// Add some big hit counts; we could be Add-ing while the
 	// _collate go-routine is also Add-ing, but it's safe enough not
 	// to worry about, and anyway, we're faster than the 1-second timer
-	m.hitsMovingAverage.Add(8.0)
-	m.hitsMovingAverage.Add(8.0)
-	m.hitsMovingAverage.Add(8.0)
+	m.total.hitsMovingAverage.Add(8.0)
+	m.total.hitsMovingAverage.Add(8.0)
+	m.total.hitsMovingAverage.Add(8.0)
 
 	// Expect no alert to be issued; we will have timed out instead.
 	alert, err := getAlertWithTimeout(m, time.Duration(2)*time.Second)
@@ -79,6 +84,636 @@ func (s *MySuite) TestNoAlert(c *C) {
 	c.Assert(alert, IsNil)
 }
 
+func (s *MySuite) TestUnknownFormat(c *C) {
+	tmpFile := filepath.Join(s.tmpDir, "TestUnknownFormat")
+	err := ioutil.WriteFile(tmpFile, []byte{'t', 'e', 's', 't', '\n'}, 0666)
+	c.Assert(err, IsNil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	_, err = NewAndRun(ctx, &Config{Filenames: []string{tmpFile}, AlertThreshold: 10, Format: "no-such-format"})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestDetectFormat(c *C) {
+	tmpFile := filepath.Join(s.tmpDir, "TestDetectFormat")
+	err := ioutil.WriteFile(tmpFile, []byte(
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326 "-" "curl/7.1"`+"\n"+
+			`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /a/c HTTP/1.0" 200 23 "-" "curl/7.1"`+"\n"), 0666)
+	c.Assert(err, IsNil)
+
+	format, err := detectFormat(tmpFile, "")
+	c.Assert(err, IsNil)
+	c.Check(format.Name, Equals, "combined")
+
+	// Nothing to detect, so the default is used
+	err = ioutil.WriteFile(tmpFile, []byte{}, 0666)
+	c.Assert(err, IsNil)
+	format, err = detectFormat(tmpFile, "")
+	c.Assert(err, IsNil)
+	c.Check(format.Name, Equals, kDefaultFormat)
+}
+
+func (s *MySuite) TestTailExtended(c *C) {
+	tmpFile := filepath.Join(s.tmpDir, "TestTailExtended")
+	c.Assert(ioutil.WriteFile(tmpFile, []byte{}, 0666), IsNil)
+	appendLines(c, tmpFile,
+		`#Version: 1.0`,
+		`#Fields: date time c-ip cs-method cs-uri-stem sc-status sc-bytes`,
+		`2017-06-01 13:55:36 10.0.0.1 GET /a/b 200 2326`)
+
+	// The tail starts at the end of the file, after the #Fields
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{Filenames: []string{tmpFile}, AlertThreshold: 10})
+	c.Assert(err, IsNil)
+
+	time.Sleep(500 * time.Millisecond)
+	appendLines(c, tmpFile, `2017-06-01 13:55:37 10.0.0.1 GET /a/c 200 2326`)
+
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.HitsLastSecond > 0
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+	c.Check(status.HitsLastSecond, Equals, 1)
+}
+
+func (s *MySuite) TestTolerant(c *C) {
+	tmpFile := filepath.Join(s.tmpDir, "TestTolerant")
+	err := ioutil.WriteFile(tmpFile, []byte{}, 0666)
+	c.Assert(err, IsNil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{Filenames: []string{tmpFile}, AlertThreshold: 10, Format: "common", Tolerant: true})
+	c.Assert(err, IsNil)
+
+	// Give the tail time to start, then add a good and a bad line
+	time.Sleep(500 * time.Millisecond)
+	appendLines(c, tmpFile,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] GET`)
+
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.BadLines > 0
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+	c.Check(status.BadLines, Equals, 1)
+	c.Assert(status.RecentBadLines, HasLen, 1)
+	c.Check(status.RecentBadLines[0].LineNumber, Equals, 2)
+	c.Check(status.RecentBadLines[0].Column, Equals, 44)
+}
+
+func (s *MySuite) TestMultipleFiles(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestMultipleFiles")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+	for _, name := range []string{"a.access.log", "b.access.log", "error.log"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0666)
+		c.Assert(err, IsNil)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filepath.Join(dir, "*.access.log")},
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+	c.Check(m.sources, HasLen, 2)
+
+	// Give the tails time to start, then add lines to each log
+	time.Sleep(500 * time.Millisecond)
+	appendLines(c, filepath.Join(dir, "a.access.log"),
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/c HTTP/1.0" 200 2326`)
+	appendLines(c, filepath.Join(dir, "b.access.log"),
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /b/c HTTP/1.0" 200 2326`)
+
+	var total int
+	bySource := make(map[string]int)
+	_, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		for source, sourceStatus := range status.BySource {
+			bySource[filepath.Base(source)] += sourceStatus.HitsLastSecond
+		}
+		return total == 3
+	})
+	c.Assert(err, IsNil)
+	c.Check(total, Equals, 3)
+	c.Check(bySource, DeepEquals, map[string]int{"a.access.log": 2, "b.access.log": 1})
+}
+
+func (s *MySuite) TestWatch(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestWatch")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filepath.Join(dir, "*.access.log")},
+		Watch:          true,
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+
+	// A new log is read from its start
+	newLog := filepath.Join(dir, "new.access.log")
+	err = ioutil.WriteFile(newLog, []byte(
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`+"\n"), 0666)
+	c.Assert(err, IsNil)
+
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.BySource[newLog].HitsLastSecond == 1
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+
+	// And is forgotten once it is removed
+	c.Assert(os.Remove(newLog), IsNil)
+	status, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		_, has := status.BySource[newLog]
+		return !has
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+}
+
+func (s *MySuite) TestWatchRenamed(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestWatchRenamed")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filepath.Join(dir, "*.access.log")},
+		Watch:          true,
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	newLog := filepath.Join(dir, "new.access.log")
+	c.Assert(ioutil.WriteFile(newLog, []byte(line+"\n"), 0666), IsNil)
+	_, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.BySource[newLog].HitsLastSecond == 1
+	})
+	c.Assert(err, IsNil)
+
+	// The lines written just before the log is renamed are still read
+	appendLines(c, newLog, line, line, line)
+	c.Assert(os.Rename(newLog, newLog+".1"), IsNil)
+	var total int
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		_, has := status.BySource[newLog]
+		return total == 3 && !has
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+	c.Check(total, Equals, 3)
+}
+
+func (s *MySuite) TestWatchDirectoryPattern(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestWatchDirectoryPattern")
+	for _, site := range []string{"a", "b"} {
+		c.Assert(os.MkdirAll(filepath.Join(dir, site), 0777), IsNil)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filepath.Join(dir, "*", "access.log")},
+		Watch:          true,
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+
+	// A new log in any of the directories is read
+	newLog := filepath.Join(dir, "b", "access.log")
+	err = ioutil.WriteFile(newLog, []byte(
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`+"\n"), 0666)
+	c.Assert(err, IsNil)
+
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.BySource[newLog].HitsLastSecond == 1
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+
+	// But there must be a directory to watch
+	_, err = NewAndRun(ctx, &Config{
+		Filenames: []string{filepath.Join(dir, "no-such-*", "access.log")},
+		Watch:     true,
+	})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestReplay(c *C) {
+	filename := filepath.Join(s.tmpDir, "TestReplay.log")
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+	appendLines(c, filename,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/c HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /b/c HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /b/c HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:37 -0700] "GET /b/c HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:39 -0700] "GET /a/b HTTP/1.0" 200 2326`)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filename},
+		AlertThreshold: 3,
+		Format:         "common",
+		Replay:         true,
+		ReplaySpeed:    0,
+	})
+	c.Assert(err, IsNil)
+
+	// The replay sends a Status for every second of log time, and the
+	// Sites at its end
+	var hits []int
+	var alerts []*Alert
+	var sites *Sites
+	timeout := time.After(5 * time.Second)
+	for sites == nil {
+		select {
+		case status := <-m.StatusChan:
+			hits = append(hits, status.HitsLastSecond)
+		case alert := <-m.AlertChan:
+			alerts = append(alerts, alert)
+		case sites = <-m.SitesChan:
+		case err = <-m.ErrorChan:
+			c.Fatal(err)
+		case <-timeout:
+			c.Fatal("Timed out waiting for the replay to finish")
+		}
+	}
+	c.Check(hits, DeepEquals, []int{3, 5, 0, 1})
+	c.Check(sites.Sites, DeepEquals, []Site{
+		{TotalHits: 6, Site: "/a", Bytes: 6 * 2326},
+		{TotalHits: 3, Site: "/b", Bytes: 3 * 2326},
+	})
+
+	// The alert fires and recovers at the log's time
+	logStart := time.Date(2015, 2, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	c.Assert(alerts, HasLen, 2)
+	c.Check(alerts[0].InAlertState, Equals, true)
+	c.Check(alerts[0].Time.Equal(logStart.Add(2*time.Second)), Equals, true)
+	c.Check(alerts[1].InAlertState, Equals, false)
+	c.Check(alerts[1].Time.Equal(logStart.Add(3*time.Second)), Equals, true)
+}
+
+func (s *MySuite) TestStatusClasses(c *C) {
+	status, _, sites := replayLines(c, &Config{AlertThreshold: 10, Format: "common"},
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 301 0`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 404 0`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 500 0`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /b/c HTTP/1.0" 503 0`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /b/c HTTP/1.0" 200 2326`)
+
+	c.Assert(status, NotNil)
+	c.Check([]int{status.Hits2xx, status.Hits3xx, status.Hits4xx, status.Hits5xx}, DeepEquals, []int{2, 1, 1, 2})
+	c.Check(status.BytesLastSecond, Equals, int64(2*2326))
+	c.Check(sites.Sites, DeepEquals, []Site{
+		{TotalHits: 4, Site: "/a", Errors: 1, ErrorRate: 0.25, Bytes: 2326},
+		{TotalHits: 2, Site: "/b", Errors: 1, ErrorRate: 0.5, Bytes: 2326},
+	})
+}
+
+func (s *MySuite) TestErrorRateAlert(c *C) {
+	var lines []string
+	for second, status := range map[int]int{36: 200, 37: 500, 38: 500, 41: 200} {
+		for i := 0; i < 4; i++ {
+			lines = append(lines, fmt.Sprintf(`127.0.0.1 - - [10/Feb/2015:13:55:%02d -0700] "GET /a/b HTTP/1.0" %d 0`, second, status))
+		}
+	}
+	sort.Strings(lines)
+
+	// The 5xx are half of the hits of the first two seconds, and all of
+	// the hits of the next two; then the hits stop, and the alert recovers
+	_, alerts, _ := replayLines(c, &Config{
+		AlertThreshold:     10,
+		Format:             "common",
+		ServerErrorPercent: 60,
+		ErrorRateWindow:    2 * time.Second,
+		ErrorRateMinHits:   4,
+	}, lines...)
+	c.Assert(alerts, HasLen, 2)
+	c.Check(alerts[0].InAlertState, Equals, true)
+	c.Check(alerts[0].Rule, Equals, kServerErrorRule)
+	c.Check(alerts[0].Reason, Equals, "5xx in 100.0% of 8 hits over 2s")
+	c.Check(alerts[1].InAlertState, Equals, false)
+	c.Check(alerts[1].Reason, Equals, "only 0 hits over 2s")
+}
+
+func (s *MySuite) TestAlertsOfEndedLog(c *C) {
+	line := func(second int, status int) string {
+		return fmt.Sprintf(`127.0.0.1 - - [10/Feb/2015:13:55:%02d -0700] "GET /a/b HTTP/1.0" %d 0`, second, status)
+	}
+	rotated := filepath.Join(c.MkDir(), "access.log.1")
+	c.Assert(ioutil.WriteFile(rotated, []byte{}, 0666), IsNil)
+	appendLines(c, rotated, line(36, 500), line(36, 500), line(37, 500), line(37, 500))
+
+	// The alert on the rotated log recovers once it has been read
+	_, alerts, _ := replayLines(c, &Config{
+		AlertThreshold:     10,
+		AlertPerSource:     true,
+		Format:             "common",
+		Rotated:            []string{rotated},
+		ServerErrorPercent: 60,
+		ErrorRateWindow:    2 * time.Second,
+		ErrorRateMinHits:   2,
+	}, line(38, 200), line(38, 200))
+	var states []bool
+	var reasons []string
+	for _, alert := range alerts {
+		if alert.Source == rotated {
+			states = append(states, alert.InAlertState)
+			reasons = append(reasons, alert.Reason)
+		}
+	}
+	c.Check(states, DeepEquals, []bool{true, false})
+	c.Check(reasons, DeepEquals, []string{"5xx in 100.0% of 2 hits over 2s", "the log has ended"})
+}
+
+func (s *MySuite) TestReplayMultipleFiles(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestReplayMultipleFiles")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+	for _, name := range []string{"a.log", "b.log"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0666), IsNil)
+	}
+
+	_, err := NewAndRun(context.Background(), &Config{
+		Filenames: []string{filepath.Join(dir, "*.log")},
+		Replay:    true,
+	})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestReplayWithWatch(c *C) {
+	_, err := NewAndRun(context.Background(), &Config{
+		Filenames: []string{filepath.Join(s.tmpDir, "*.log")},
+		Replay:    true,
+		Watch:     true,
+	})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestRotatedWithoutReplay(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestRotatedWithoutReplay")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+	line := func(second int) string {
+		return fmt.Sprintf(`127.0.0.1 - - [10/Feb/2015:13:55:%02d -0700] "GET /a/b HTTP/1.0" 200 2326`, second)
+	}
+	filename := filepath.Join(dir, "access.log")
+	c.Assert(ioutil.WriteFile(filename+".1", []byte{}, 0666), IsNil)
+	appendLines(c, filename+".1", line(36), line(36), line(37))
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+	appendLines(c, filename, line(38))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filename},
+		Rotated:        []string{filename + ".*"},
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+
+	// The logs are replayed up to now
+	var hits []int
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case status := <-m.StatusChan:
+			hits = append(hits, status.HitsLastSecond)
+		case <-m.AlertChan:
+		case <-m.SitesChan:
+			done = true
+		case err = <-m.ErrorChan:
+			c.Fatal(err)
+		case <-timeout:
+			c.Fatal("Timed out waiting for the logs to be replayed")
+		}
+	}
+	c.Check(hits, DeepEquals, []int{2, 1, 1})
+
+	// And then the log is tailed from there
+	appendLines(c, filename, line(39), line(39))
+	var total int
+	_, err = getStatusWithTimeout(m, time.Duration(3)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		return false
+	})
+	c.Assert(err, IsNil)
+	c.Check(total, Equals, 2)
+
+	// As for a replay, there is only one log file, which is not watched for
+	for _, config := range []*Config{
+		{Filenames: []string{filename}, Watch: true},
+		{Filenames: []string{filename}, StateFile: filepath.Join(dir, "state")},
+		{Filenames: []string{kStdin}},
+	} {
+		config.Rotated = []string{filename + ".*"}
+		_, err = NewAndRun(ctx, config)
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *MySuite) TestRotated(c *C) {
+	dir := filepath.Join(s.tmpDir, "TestRotated")
+	c.Assert(os.Mkdir(dir, 0777), IsNil)
+	line := func(second int) string {
+		return fmt.Sprintf(`127.0.0.1 - - [10/Feb/2015:13:55:%02d -0700] "GET /a/b HTTP/1.0" 200 2326`+"\n", second)
+	}
+
+	// The oldest log is compressed
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err := gzipWriter.Write([]byte(line(36) + line(36)))
+	c.Assert(err, IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "access.log.2.gz"), compressed.Bytes(), 0666), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "access.log.1"), []byte(line(37)), 0666), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "access.log"), []byte(line(38)), 0666), IsNil)
+
+	// With the same modification times, the rotation numbers give the order
+	now := time.Now()
+	for _, name := range []string{"access.log.2.gz", "access.log.1"} {
+		c.Assert(os.Chtimes(filepath.Join(dir, name), now, now), IsNil)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filepath.Join(dir, "access.log")},
+		Rotated:        []string{filepath.Join(dir, "access.log.*")},
+		AlertThreshold: 10,
+		Format:         "common",
+		Replay:         true,
+	})
+	c.Assert(err, IsNil)
+
+	var hits []int
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case status := <-m.StatusChan:
+			hits = append(hits, status.HitsLastSecond)
+		case <-m.AlertChan:
+		case <-m.SitesChan:
+			done = true
+		case err = <-m.ErrorChan:
+			c.Fatal(err)
+		case <-timeout:
+			c.Fatal("Timed out waiting for the logs to be read")
+		}
+	}
+	c.Check(hits, DeepEquals, []int{2, 1, 1})
+}
+
+func (s *MySuite) TestEventTime(c *C) {
+	filename := filepath.Join(s.tmpDir, "TestEventTime.log")
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:       []string{filename},
+		AlertThreshold:  10,
+		Format:          "common",
+		EventTime:       true,
+		AllowedLateness: 2 * time.Second,
+	})
+	c.Assert(err, IsNil)
+
+	// Two hits from a second ago, which are counted together, one from an
+	// hour ago, which is too late, and one from an hour from now, which is
+	// too early
+	time.Sleep(500 * time.Millisecond)
+	const layout = "02/Jan/2006:15:04:05 -0700"
+	recent := time.Now().Add(-time.Second).Format(layout)
+	old := time.Now().Add(-time.Hour).Format(layout)
+	future := time.Now().Add(time.Hour).Format(layout)
+	appendLines(c, filename,
+		`127.0.0.1 - - [`+recent+`] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [`+old+`] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [`+future+`] "GET /a/b HTTP/1.0" 200 2326`,
+		`127.0.0.1 - - [`+recent+`] "GET /a/c HTTP/1.0" 200 2326`)
+
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		return status.HitsLastSecond > 0
+	})
+	c.Assert(err, IsNil)
+	c.Check(status.HitsLastSecond, Equals, 2)
+	c.Check(status.LateEntries, Equals, 2)
+}
+
+// Run a Collator with a state file until it has counted the lines, calling
+// during once it has started, and return how many hits it counted
+func runWithStateFile(c *C, filename string, stateFile string, during func()) int {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{filename},
+		AlertThreshold: 10,
+		Format:         "common",
+		StateFile:      stateFile,
+	})
+	c.Assert(err, IsNil)
+
+	time.Sleep(500 * time.Millisecond)
+	if during != nil {
+		during()
+	}
+	var total int
+	getStatusWithTimeout(m, time.Duration(2)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		return false
+	})
+	cancelFunc()
+	c.Assert(m.Wait(), IsNil)
+	return total
+}
+
+func (s *MySuite) TestStateFile(c *C) {
+	filename := filepath.Join(s.tmpDir, "TestStateFile.log")
+	stateFile := filepath.Join(s.tmpDir, "TestStateFile.state")
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	c.Assert(ioutil.WriteFile(filename, []byte(line+"\n"+line+"\n"), 0666), IsNil)
+
+	run := func(during func()) int {
+		return runWithStateFile(c, filename, stateFile, during)
+	}
+
+	// With no saved position, the file is read from its end
+	c.Check(run(func() { appendLines(c, filename, line) }), Equals, 1)
+
+	// The lines written while the Collator was stopped are read
+	appendLines(c, filename, line, line, line)
+	c.Check(run(nil), Equals, 3)
+
+	// A rotated file is read from its start
+	c.Assert(os.Remove(filename), IsNil)
+	c.Assert(ioutil.WriteFile(filename, []byte(line+"\n"+line+"\n"), 0666), IsNil)
+	c.Check(run(nil), Equals, 2)
+}
+
+func (s *MySuite) TestStateFileRotation(c *C) {
+	filename := filepath.Join(s.tmpDir, "TestStateFileRotation.log")
+	stateFile := filepath.Join(s.tmpDir, "TestStateFileRotation.state")
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	c.Assert(ioutil.WriteFile(filename, []byte(line+"\n"+line+"\n"), 0666), IsNil)
+
+	run := func(during func()) int {
+		return runWithStateFile(c, filename, stateFile, during)
+	}
+
+	// A file rotated while it is tailed is followed, and is resumed from
+	// where it was read in the new file
+	c.Check(run(func() {
+		c.Assert(os.Rename(filename, filename+".1"), IsNil)
+		c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+		appendLines(c, filename, line, line, line)
+	}), Equals, 3)
+	appendLines(c, filename, line)
+	c.Check(run(nil), Equals, 1)
+}
+
+func (s *MySuite) TestNoMatchingFiles(c *C) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	_, err := NewAndRun(ctx, &Config{Filenames: []string{filepath.Join(s.tmpDir, "*.no-such-log")}, AlertThreshold: 10})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestErrorWindow(c *C) {
+	window := newErrorWindow(200)
+	for i := 0; i < kErrorRateMinLines-1; i++ {
+		window.add(true)
+	}
+	// Not enough lines yet
+	c.Check(window.exceeds(50), Equals, false)
+
+	for i := 0; i < 200; i++ {
+		window.add(i%4 == 0)
+	}
+	c.Check(window.numBad, Equals, 50)
+	c.Check(window.exceeds(20), Equals, true)
+	c.Check(window.exceeds(25), Equals, false)
+}
+
 // Wait for an Alert, but also time out after timeoutDuration, and return nil
 // If an error was received from the Collator, return it too.
 func getAlertWithTimeout(m *Collator, timeoutDuration time.Duration) (*Alert, error) {
@@ -105,3 +740,73 @@ func getAlertWithTimeout(m *Collator, timeoutDuration time.Duration) (*Alert, er
 		}
 	}
 }
+
+// Replay the lines with the config, and return the last Status, the Alerts,
+// and the Sites that are sent at the end of the replay.
+func replayLines(c *C, config *Config, lines ...string) (*Status, []*Alert, *Sites) {
+	filename := filepath.Join(c.MkDir(), "access.log")
+	c.Assert(ioutil.WriteFile(filename, []byte{}, 0666), IsNil)
+	appendLines(c, filename, lines...)
+	config.Filenames = []string{filename}
+	config.Replay = true
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, config)
+	c.Assert(err, IsNil)
+
+	var status *Status
+	var alerts []*Alert
+	var sites *Sites
+	timeout := time.After(5 * time.Second)
+	for sites == nil {
+		select {
+		case status = <-m.StatusChan:
+		case alert := <-m.AlertChan:
+			alerts = append(alerts, alert)
+		case sites = <-m.SitesChan:
+		case err = <-m.ErrorChan:
+			c.Fatal(err)
+		case <-timeout:
+			c.Fatal("Timed out waiting for the replay to finish")
+		}
+	}
+	return status, alerts, sites
+}
+
+// Wait for a Status which satisfies the predicate, but also time out after
+// timeoutDuration, and return nil. If an error was received from the
+// Collator, return it too.
+func getStatusWithTimeout(m *Collator, timeoutDuration time.Duration, predicate func(*Status) bool) (*Status, error) {
+	timeout := time.NewTimer(timeoutDuration)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-timeout.C:
+			return nil, nil
+		case err := <-m.ErrorChan:
+			log.Printf("Received error from ErrorChan: %s", err)
+			return nil, err
+		case <-m.SitesChan:
+			// ignore it
+		case <-m.AlertChan:
+			// ignore it
+		case status := <-m.StatusChan:
+			if predicate(status) {
+				return status, nil
+			}
+		}
+	}
+}
+
+// Append lines to a log file
+func appendLines(c *C, filename string, lines ...string) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0666)
+	c.Assert(err, IsNil)
+	for _, line := range lines {
+		_, err = file.WriteString(line + "\n")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(file.Close(), IsNil)
+}
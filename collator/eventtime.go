@@ -0,0 +1,66 @@
+package collator
+
+import (
+	"time"
+)
+
+// The buckets of an event-time aggregation. Entries are held in the bucket
+// of the second given by their time, until that second is older than the
+// allowed lateness; then they are counted, and the Status for that second
+// is sent.
+type eventBuckets struct {
+	// How long to wait for the entries of a second
+	lateness time.Duration
+
+	// The entries of each second that has not been counted yet, by its
+	// Unix time
+	pending map[int64][]*record
+
+	// The first second that has not been counted yet; entries before it
+	// are too late
+	next int64
+
+	// The number of entries that came too late to be counted, or whose
+	// time is too far in the future
+	late int
+}
+
+func newEventBuckets(lateness time.Duration, now time.Time) *eventBuckets {
+	return &eventBuckets{
+		lateness: lateness,
+		pending:  make(map[int64][]*record),
+		next:     now.Add(-lateness).Unix(),
+	}
+}
+
+// Hold a record in the bucket of its second. A record without a time,
+// or the end of a log, is held in the bucket of the current second.
+// A record that is too late is only counted as late, and so is one that
+// is more than the allowed lateness in the future, as its clock must be
+// wrong, and it would be held for too long.
+func (self *eventBuckets) add(record *record, now time.Time) {
+	t := now
+	if !record.closed && !record.entry.Time.IsZero() {
+		t = record.entry.Time
+	}
+	second := t.Unix()
+	if second < self.next || t.After(now.Add(self.lateness)) {
+		self.late++
+		return
+	}
+	self.pending[second] = append(self.pending[second], record)
+}
+
+// Count the entries of every second that is now older than the allowed
+// lateness, and send the Status for each of them.
+func (self *Collator) closeEventBuckets(now time.Time) {
+	buckets := self.eventBuckets
+	watermark := now.Add(-buckets.lateness).Unix()
+	for ; buckets.next < watermark; buckets.next++ {
+		for _, record := range buckets.pending[buckets.next] {
+			self.applyRecord(record, time.Unix(buckets.next+1, 0))
+		}
+		delete(buckets.pending, buckets.next)
+		self.tick(time.Unix(buckets.next+1, 0))
+	}
+}
@@ -0,0 +1,123 @@
+package collator
+
+import (
+	"bufio"
+	"github.com/gilramir/monitor-weblog/xojoc/logparse"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const (
+	// The Format name which asks for the log format to be detected
+	kAutoFormat = "auto"
+
+	// How many lines to sample from the start of a log file to detect its format
+	kDetectLines = 100
+
+	// The format to use if the log file has nothing to detect a format from
+	kDefaultFormat = "common"
+
+	// The Format names for a custom Apache LogFormat and nginx log_format
+	kApacheFormat = "apache"
+	kNginxFormat  = "nginx"
+
+	// The Format name for JSON lines, which can also be given a mapping
+	kJSONFormat = "json"
+)
+
+// Create the Parser for the log format given in the Config, for one log
+// file, whose first line is given. Each log has its own Parser, as a format
+// can be detected differently for each log, and some Parsers keep state.
+func newParser(config *Config, filename string, firstLine string) (logparse.Parser, error) {
+	switch config.Format {
+	case "", kAutoFormat:
+		format, err := detectFormat(filename, firstLine)
+		if err != nil {
+			return nil, err
+		}
+		return format.NewParser(), nil
+
+	case kApacheFormat:
+		if config.LogFormat == "" {
+			return nil, errors.New("The apache log format needs a LogFormat string")
+		}
+		parser, err := logparse.CompileApache(config.LogFormat)
+		if err != nil {
+			return nil, errors.Wrap(err, "Compiling the Apache LogFormat")
+		}
+		return parser, nil
+
+	case kNginxFormat:
+		if config.LogFormat == "" {
+			return nil, errors.New("The nginx log format needs a log_format string")
+		}
+		parser, err := logparse.CompileNginx(config.LogFormat)
+		if err != nil {
+			return nil, errors.Wrap(err, "Compiling the nginx log_format")
+		}
+		return parser, nil
+
+	case kJSONFormat:
+		mapping, err := logparse.ParseJSONMapping(config.LogFormat)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parsing the JSON field mapping")
+		}
+		return logparse.NewJSON(mapping), nil
+
+	default:
+		format := logparse.LookupFormat(config.Format)
+		if format == nil {
+			return nil, errors.Errorf("Unknown log format %s", config.Format)
+		}
+		return format.NewParser(), nil
+	}
+}
+
+// Give a new Parser the directives at the start of a log file, such as the
+// #Fields of a W3C extended log, which it needs to parse the entries, but
+// would never see if the log is tailed from its end. If the log is read from
+// its start, the Parser sees them again, which does no harm.
+func primeParser(parser logparse.Parser, filename string) error {
+	reader, err := openLog(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "#") {
+		// A directive that cannot be parsed is reported if the line is read
+		parser(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Read the first lines of a log file and find the format that parses most
+// of them. A stream cannot be read twice, so only its first line is used.
+// If the log has no lines, or none of them can be parsed, the default
+// format is returned.
+func detectFormat(filename string, firstLine string) (*logparse.Format, error) {
+	lines := []string{firstLine}
+	if !isStream(filename) {
+		reader, err := openLog(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		lines = make([]string, 0, kDetectLines)
+		scanner := bufio.NewScanner(reader)
+		for len(lines) < kDetectLines && scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	format := logparse.Detect(lines)
+	if format == nil {
+		format = logparse.LookupFormat(kDefaultFormat)
+	}
+	return format, nil
+}
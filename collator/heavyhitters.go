@@ -0,0 +1,86 @@
+package collator
+
+import (
+	"container/heap"
+)
+
+// The names with the most hits, among more names than can be counted, by
+// the Space-Saving algorithm (Metwally, Agrawal and El Abbadi, 2005). At
+// most max names are counted; once there are that many, a hit on a new name
+// takes the place of the name with the fewest hits, and its count plus one.
+// So a name that only starts to get hits later can still get to the top,
+// instead of being lumped in with the rest, and the count of a name is at
+// most too high by the count that it took over.
+type heavyHitters struct {
+	max    int
+	byName map[string]*heavyHitter
+	fewest hitterHeap
+}
+
+type heavyHitter struct {
+	name  string
+	hits  int
+	index int
+}
+
+func newHeavyHitters(max int) *heavyHitters {
+	return &heavyHitters{
+		max:    max,
+		byName: make(map[string]*heavyHitter),
+	}
+}
+
+// Count a hit on a name.
+func (self *heavyHitters) add(name string) {
+	hitter, has := self.byName[name]
+	switch {
+	case has:
+		hitter.hits++
+		heap.Fix(&self.fewest, hitter.index)
+	case len(self.fewest) < self.max:
+		hitter = &heavyHitter{name: name, hits: 1}
+		self.byName[name] = hitter
+		heap.Push(&self.fewest, hitter)
+	default:
+		hitter = self.fewest[0]
+		delete(self.byName, hitter.name)
+		hitter.name = name
+		hitter.hits++
+		self.byName[name] = hitter
+		heap.Fix(&self.fewest, 0)
+	}
+}
+
+// Find the n names with the most hits, sorted by their number of hits, and
+// then by name
+func (self *heavyHitters) top(n int) []Count {
+	hits := make(map[string]int, len(self.byName))
+	for name, hitter := range self.byName {
+		hits[name] = hitter.hits
+	}
+	return topCounts(hits, n)
+}
+
+// A min-heap of the names, by their hits
+type hitterHeap []*heavyHitter
+
+func (h hitterHeap) Len() int           { return len(h) }
+func (h hitterHeap) Less(i, j int) bool { return h[i].hits < h[j].hits }
+func (h hitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hitterHeap) Push(x interface{}) {
+	hitter := x.(*heavyHitter)
+	hitter.index = len(*h)
+	*h = append(*h, hitter)
+}
+
+func (h *hitterHeap) Pop() interface{} {
+	old := *h
+	hitter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return hitter
+}
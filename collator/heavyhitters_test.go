@@ -0,0 +1,21 @@
+package collator
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestHeavyHitters(c *C) {
+	hitters := newHeavyHitters(2)
+	for _, name := range []string{"a", "a", "a", "b", "c"} {
+		hitters.add(name)
+	}
+	// c takes the place of b, and its hit
+	c.Check(hitters.top(2), DeepEquals, []Count{{"a", 3}, {"c", 2}})
+
+	// A name that comes late, but gets many hits, gets to the top
+	for i := 0; i < 5; i++ {
+		hitters.add("d")
+	}
+	c.Check(hitters.top(1), DeepEquals, []Count{{"d", 7}})
+	c.Check(hitters.top(3), DeepEquals, []Count{{"d", 7}, {"a", 3}})
+}
@@ -0,0 +1,158 @@
+package collator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// A log name with this prefix is a local address, and an optional
+	// path, on which to accept log lines that are POSTed; e.g.
+	// http://:8080/logs
+	kHTTPScheme = "http://"
+
+	// The prefix of the source of the lines in each request, which is
+	// followed by the kSourceHeader header, or else the sender's address
+	kHTTPSource = "http:"
+
+	// The header which names the source of the lines in a request
+	kSourceHeader = "X-Log-Source"
+
+	// The largest request body that is accepted
+	kMaxIngestSize = 10 << 20
+)
+
+// Listen for HTTP requests, and send the lines that are POSTed. The
+// returned channel is closed when the listening stops.
+func (self *Collator) startHTTP(ctx context.Context, name string, lineChan chan<- *logLine) (<-chan struct{}, error) {
+	address := strings.TrimPrefix(name, kHTTPScheme)
+	path := "/"
+	if slash := strings.IndexByte(address, '/'); slash >= 0 {
+		address, path = address[:slash], address[slash:]
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Listening for log lines on %s", address)
+	}
+	self.listenAddrs[name] = listener.Addr()
+
+	sources := newListenerSources(kHTTPSource)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ingest(ctx, w, r, sources, lineChan)
+	})
+	server := &http.Server{Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := server.Serve(listener)
+		if err != nil && ctx.Err() == nil {
+			self.sendError(errors.Wrap(err, "Listening for log lines"))
+		}
+	}()
+
+	// Stop listening when the Collator stops
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return done, nil
+}
+
+// Accept a batch of log lines, which are either plain text, one per line,
+// or a JSON array. The elements of the array are either lines, or objects
+// which are each taken as a line of JSON.
+func ingest(ctx context.Context, w http.ResponseWriter, r *http.Request, sources *listenerSources, lineChan chan<- *logLine) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Log lines must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, kMaxIngestSize)
+	var buffer bytes.Buffer
+	_, err := io.Copy(&buffer, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	lines, err := ingestLines(r.Header.Get("Content-Type"), buffer.Bytes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := kHTTPSource + r.Header.Get(kSourceHeader)
+	if source == kHTTPSource {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		source += host
+	}
+	source = sources.find(source)
+
+	for _, line := range lines {
+		select {
+		case lineChan <- &logLine{source: source, text: line}:
+		case <-r.Context().Done():
+			return
+		case <-ctx.Done():
+			http.Error(w, "Stopping", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Split the body of a request into log lines. The body is JSON if its
+// Content-Type says so, or if it has none and looks like a JSON array;
+// otherwise it is text, even if a line starts with "[".
+func ingestLines(contentType string, body []byte) ([]string, error) {
+	var isJSON bool
+	if contentType == "" {
+		isJSON = bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+	} else {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		isJSON = mediaType == "application/json"
+	}
+	if !isJSON {
+		text := strings.TrimSuffix(string(body), "\n")
+		if text == "" {
+			return nil, nil
+		}
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSuffix(line, "\r")
+		}
+		return lines, nil
+	}
+
+	var elements []json.RawMessage
+	err := json.Unmarshal(body, &elements)
+	if err != nil {
+		return nil, errors.Wrap(err, "Expected a JSON array of log lines")
+	}
+	lines := make([]string, 0, len(elements))
+	for _, element := range elements {
+		var line string
+		if json.Unmarshal(element, &line) == nil {
+			lines = append(lines, line)
+			continue
+		}
+		var compact bytes.Buffer
+		err = json.Compact(&compact, element)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, compact.String())
+	}
+	return lines, nil
+}
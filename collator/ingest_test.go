@@ -0,0 +1,70 @@
+package collator
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (s *MySuite) TestIngestLines(c *C) {
+	lines, err := ingestLines("text/plain", []byte("a\nb\r\n"))
+	c.Assert(err, IsNil)
+	c.Check(lines, DeepEquals, []string{"a", "b"})
+
+	lines, err = ingestLines("application/json", []byte(`["a", {"b": 1}]`))
+	c.Assert(err, IsNil)
+	c.Check(lines, DeepEquals, []string{"a", `{"b":1}`})
+
+	_, err = ingestLines("application/json", []byte(`{"b": 1}`))
+	c.Check(err, NotNil)
+
+	// Without a Content-Type, a JSON array is recognized
+	lines, err = ingestLines("", []byte(`["a"]`))
+	c.Assert(err, IsNil)
+	c.Check(lines, DeepEquals, []string{"a"})
+
+	// But text is text, even if it looks like JSON
+	lines, err = ingestLines("text/plain; charset=utf-8", []byte("[a]\n"))
+	c.Assert(err, IsNil)
+	c.Check(lines, DeepEquals, []string{"[a]"})
+}
+
+func (s *MySuite) TestIngest(c *C) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{kHTTPScheme + "127.0.0.1:0/logs"},
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+	url := "http://" + m.listenAddrs[kHTTPScheme+"127.0.0.1:0/logs"].String() + "/logs"
+
+	// The lines are sent while the Status is read, as each request waits
+	// for its lines to be taken
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	responses := make(chan int, 1)
+	go func() {
+		request, _ := http.NewRequest("POST", url, strings.NewReader(line+"\n"+line+"\n"))
+		request.Header.Set(kSourceHeader, "web1")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		response.Body.Close()
+		responses <- response.StatusCode
+	}()
+
+	var total int
+	status, err := getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		return total == 2
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status, NotNil)
+	c.Check(status.BySource["http:web1"].HitsLastSecond > 0, Equals, true)
+	c.Check(<-responses, Equals, http.StatusNoContent)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package collator
+
+import (
+	"os"
+	"syscall"
+)
+
+// The device and the inode of a file, which tell whether it was replaced
+func fileIdentity(info os.FileInfo) (device uint64, inode uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), uint64(stat.Ino)
+	}
+	return 0, 0
+}
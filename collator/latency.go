@@ -0,0 +1,123 @@
+package collator
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The latency sketch counts the durations of the requests in buckets
+	// whose bounds grow by this factor, so that a percentile is within
+	// about half of that of the true one, whatever the number of requests
+	kLatencyGrowth = 1.05
+
+	// The upper bound of the first bucket, and the lower bound of the
+	// last, which also counts anything longer
+	kLatencyMin = 100 * time.Microsecond
+	kLatencyMax = time.Hour
+
+	// How many of the sites of a set of logs have their latency counted,
+	// as each needs a sketch of its own
+	kMaxLatencySites = 100
+)
+
+// The number of buckets in a latency sketch
+var latencyBuckets = 2 + int(math.Ceil(math.Log(float64(kLatencyMax/kLatencyMin))/math.Log(kLatencyGrowth)))
+
+// The latency percentiles of some requests
+type Latency struct {
+	// The number of requests whose duration is known
+	Hits int
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// A latencySketch counts the durations of requests, in a bounded amount
+// of memory, so that their percentiles can be estimated.
+type latencySketch struct {
+	buckets []int
+	count   int
+	max     time.Duration
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: make([]int, latencyBuckets)}
+}
+
+// Count the duration of a request.
+func (self *latencySketch) add(duration time.Duration) {
+	self.buckets[latencyBucket(duration)]++
+	self.count++
+	if duration > self.max {
+		self.max = duration
+	}
+}
+
+// Forget all of the durations.
+func (self *latencySketch) reset() {
+	for i := range self.buckets {
+		self.buckets[i] = 0
+	}
+	self.count = 0
+	self.max = 0
+}
+
+// Estimate the percentiles of the durations.
+func (self *latencySketch) latency() Latency {
+	return Latency{
+		Hits: self.count,
+		P50:  self.quantile(0.50),
+		P90:  self.quantile(0.90),
+		P99:  self.quantile(0.99),
+		Max:  self.max,
+	}
+}
+
+// Estimate the duration that the fraction q of the durations are no
+// longer than.
+func (self *latencySketch) quantile(q float64) time.Duration {
+	if self.count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(self.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := 0
+	for i, n := range self.buckets {
+		seen += n
+		if seen >= rank {
+			// Nothing is longer than the longest duration
+			if estimate := latencyBucketValue(i); estimate < self.max {
+				return estimate
+			}
+			return self.max
+		}
+	}
+	return self.max
+}
+
+// The bucket of a duration. Bucket i, after the first, counts the durations
+// from kLatencyMin * kLatencyGrowth^(i-1) up to kLatencyMin * kLatencyGrowth^i.
+func latencyBucket(duration time.Duration) int {
+	if duration < kLatencyMin {
+		return 0
+	}
+	i := 1 + int(math.Log(float64(duration)/float64(kLatencyMin))/math.Log(kLatencyGrowth))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+// The duration that stands for the durations in a bucket: the middle of
+// its bounds.
+func latencyBucketValue(i int) time.Duration {
+	if i == 0 {
+		return kLatencyMin / 2
+	}
+	lower := float64(kLatencyMin) * math.Pow(kLatencyGrowth, float64(i-1))
+	return time.Duration(lower * (1 + kLatencyGrowth) / 2)
+}
@@ -0,0 +1,120 @@
+package collator
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"math"
+	"time"
+)
+
+func (s *MySuite) TestLatencySketch(c *C) {
+	sketch := newLatencySketch()
+	c.Check(sketch.latency(), Equals, Latency{})
+
+	// 1ms to 1000ms
+	for i := 1; i <= 1000; i++ {
+		sketch.add(time.Duration(i) * time.Millisecond)
+	}
+	latency := sketch.latency()
+	c.Check(latency.Hits, Equals, 1000)
+	c.Check(latency.Max, Equals, time.Second)
+	for _, test := range []struct {
+		estimate time.Duration
+		expected time.Duration
+	}{
+		{latency.P50, 500 * time.Millisecond},
+		{latency.P90, 900 * time.Millisecond},
+		{latency.P99, 990 * time.Millisecond},
+	} {
+		relativeError := math.Abs(float64(test.estimate-test.expected)) / float64(test.expected)
+		c.Check(relativeError < kLatencyGrowth-1, Equals, true,
+			Commentf("%s estimated as %s", test.expected, test.estimate))
+	}
+
+	// Durations beyond the last bucket are still counted
+	sketch.add(2 * kLatencyMax)
+	c.Check(sketch.latency().Max, Equals, 2*kLatencyMax)
+
+	sketch.reset()
+	c.Check(sketch.latency(), Equals, Latency{})
+}
+
+func (s *MySuite) TestLatencyRule(c *C) {
+	rule := &latencyRule{threshold: 100 * time.Millisecond, window: 3}
+	withP99 := func(p99 time.Duration) *second {
+		return &second{latency: Latency{Hits: 10, P99: p99}}
+	}
+
+	var changes []string
+	broken := false
+	for _, s := range []*second{
+		withP99(200 * time.Millisecond),
+		withP99(200 * time.Millisecond),
+		{}, // no requests
+		withP99(50 * time.Millisecond),
+		withP99(200 * time.Millisecond),
+		withP99(200 * time.Millisecond),
+		withP99(200 * time.Millisecond),
+		withP99(50 * time.Millisecond),
+		withP99(50 * time.Millisecond),
+		withP99(50 * time.Millisecond),
+	} {
+		isBroken, known, reason := rule.check(s)
+		if known && isBroken != broken {
+			broken = isBroken
+			changes = append(changes, fmt.Sprintf("%v: %s", broken, reason))
+		}
+	}
+	c.Check(changes, DeepEquals, []string{
+		"true: p99 of 200ms, above 100ms for 3s",
+		"false: p99 of 50ms, within 100ms for 3s",
+	})
+}
+
+func (s *MySuite) TestLatency(c *C) {
+	status, alerts, sites := replayLines(c, &Config{
+		AlertThreshold:   10,
+		Format:           "apache",
+		LogFormat:        `%h %l %u %t "%r" %>s %b %D`,
+		LatencyThreshold: 500 * time.Millisecond,
+		LatencyWindow:    time.Second,
+	},
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326 20000`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326 20000`,
+		`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /b/c HTTP/1.0" 200 2326 900000`)
+	c.Assert(status, NotNil)
+	c.Check(status.Latency.Hits, Equals, 3)
+	c.Check(status.Latency.Max, Equals, 900*time.Millisecond)
+	c.Check(status.Latency.P99 > 850*time.Millisecond, Equals, true)
+	c.Check(status.Latency.P50 < 25*time.Millisecond, Equals, true)
+
+	c.Assert(sites.Sites, HasLen, 2)
+	c.Check(sites.Sites[0].Latency.Max, Equals, 20*time.Millisecond)
+	c.Check(sites.Sites[1].Latency.Max, Equals, 900*time.Millisecond)
+
+	c.Assert(alerts, HasLen, 1)
+	c.Check(alerts[0].Rule, Equals, kLatencyRule)
+	c.Check(alerts[0].InAlertState, Equals, true)
+}
+
+func (s *MySuite) TestLatencySites(c *C) {
+	var lines []string
+	for i := 0; i <= kMaxLatencySites; i++ {
+		lines = append(lines, fmt.Sprintf(`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /%d/a HTTP/1.0" 200 2326 20000`, i))
+	}
+	_, _, sites := replayLines(c, &Config{
+		AlertThreshold: 10,
+		Format:         "apache",
+		LogFormat:      `%h %l %u %t "%r" %>s %b %D`,
+	}, lines...)
+
+	// The site after the last one to have its latency counted has none
+	c.Assert(sites.Sites, HasLen, kMaxLatencySites+1)
+	var withLatency int
+	for _, site := range sites.Sites {
+		if site.Latency.Hits > 0 {
+			withLatency++
+		}
+	}
+	c.Check(withLatency, Equals, kMaxLatencySites)
+}
@@ -0,0 +1,40 @@
+package collator
+
+import (
+	"sync"
+)
+
+// The most sources that the lines a listener receives are counted under;
+// the lines of any more sources are counted under its kOther source
+const kMaxListenerSources = 100
+
+// The sources that a listener has received lines from. As the senders name
+// them, this keeps a sender from making us keep the counters, and the
+// parser, of any number of them.
+type listenerSources struct {
+	lock  sync.Mutex
+	known map[string]bool
+	other string
+}
+
+// The sources of a listener, whose source names start with prefix
+func newListenerSources(prefix string) *listenerSources {
+	return &listenerSources{
+		known: make(map[string]bool),
+		other: prefix + kOther,
+	}
+}
+
+// The source to count the lines of a sender under
+func (self *listenerSources) find(source string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.known[source] {
+		return source
+	}
+	if len(self.known) >= kMaxListenerSources {
+		return self.other
+	}
+	self.known[source] = true
+	return source
+}
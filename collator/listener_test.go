@@ -0,0 +1,16 @@
+package collator
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestListenerSources(c *C) {
+	sources := newListenerSources(kSyslogSource)
+	for i := 0; i < kMaxListenerSources; i++ {
+		source := fmt.Sprintf("syslog:nginx@web%d", i)
+		c.Check(sources.find(source), Equals, source)
+	}
+	c.Check(sources.find("syslog:nginx@web0"), Equals, "syslog:nginx@web0")
+	c.Check(sources.find("syslog:nginx@new"), Equals, "syslog:(other)")
+}
@@ -3,12 +3,33 @@ package collator
 import (
 	"context"
 	"github.com/gilramir/monitor-weblog/xojoc/logparse"
+	"github.com/pkg/errors"
 )
 
+const (
+	// The number of most recent lines over which the error rate is measured
+	kErrorRateLines = 1000
+
+	// The error rate is not checked until this many lines have been seen
+	kErrorRateMinLines = 100
+)
+
+// A log entry, and the log file it came from. A record with closed set has
+// no entry, and says that the log file is no longer being read.
+type record struct {
+	source   string
+	entry    *logparse.Entry
+	closed   bool
+	caughtUp bool
+}
+
 // Parse one line from a log file and send the Entry object for it.
-func (self *Collator) _parse(ctx context.Context, lineChan <-chan string, entryChan chan<- *logparse.Entry) {
+func (self *Collator) _parse(ctx context.Context, lineChan <-chan *logLine, entryChan chan<- *record) {
 	defer close(entryChan)
 
+	lineNumbers := make(map[string]int)
+	window := newErrorWindow(kErrorRateLines)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -19,13 +40,133 @@ func (self *Collator) _parse(ctx context.Context, lineChan <-chan string, entryC
 			if !ok {
 				return
 			}
-			entry, err := logparse.Common(line)
+			if line.caughtUp {
+				entryChan <- &record{caughtUp: true}
+				continue
+			}
+			if line.closed {
+				// Forget the log; a new log with the same name needs a new parser
+				delete(self.parsers, line.source)
+				delete(lineNumbers, line.source)
+				entryChan <- &record{source: line.source, closed: true}
+				continue
+			}
+
+			parser, err := self.parserFor(line.source, line.text)
 			if err != nil {
-				// We encountered an error; notify the listener and abort
-				self.ErrorChan <- err
+				self.sendError(err)
 				return
 			}
-			entryChan <- entry
+			lineNumbers[line.source]++
+			entry, err := parser(line.text)
+			if err != nil {
+				if !self.config.Tolerant {
+					// We encountered an error; notify the listener and abort
+					self.sendError(errors.Wrap(err, line.source))
+					return
+				}
+				// Note the bad line, and keep going unless there are too many of them
+				window.add(true)
+				badLine := newBadLine(line.source, lineNumbers[line.source], err)
+				if self.config.MaxErrorPercent > 0 && window.exceeds(self.config.MaxErrorPercent) {
+					self.sendError(tooManyErrors(window, badLine))
+					return
+				}
+				self.badLineChan <- badLine
+				continue
+			}
+			window.add(false)
+			if entry == nil {
+				// A directive line, which has no entry
+				continue
+			}
+			entryChan <- &record{source: line.source, entry: entry}
+		}
+	}
+}
+
+// Get the Parser for a log file, creating it if this is the first line
+// from that log.
+func (self *Collator) parserFor(source string, line string) (logparse.Parser, error) {
+	parser, has := self.parsers[source]
+	if !has {
+		var err error
+		parser, err = newParser(self.config, source, line)
+		if err != nil {
+			return nil, err
 		}
+		if isFile(source) && !isStream(source) {
+			err = primeParser(parser, source)
+			if err != nil {
+				return nil, err
+			}
+		}
+		self.parsers[source] = parser
+	}
+	return parser, nil
+}
+
+func newBadLine(source string, lineNumber int, err error) *BadLine {
+	badLine := &BadLine{
+		Source:     source,
+		LineNumber: lineNumber,
+		Err:        err,
+	}
+	if syntaxError, ok := err.(*logparse.SyntaxError); ok {
+		badLine.Column = syntaxError.Column
+	}
+	return badLine
+}
+
+func tooManyErrors(window *errorWindow, badLine *BadLine) error {
+	return errors.Errorf("%d of the last %d lines could not be parsed; %s line %d: %s",
+		window.numBad, window.numLines(), badLine.Source, badLine.LineNumber, badLine.Err)
+}
+
+// The errorWindow remembers which of the most recent lines could not be parsed.
+type errorWindow struct {
+	bad    []bool
+	pos    int
+	filled bool
+	numBad int
+}
+
+func newErrorWindow(size int) *errorWindow {
+	return &errorWindow{
+		bad: make([]bool, size),
+	}
+}
+
+// Record whether the next line was bad
+func (self *errorWindow) add(bad bool) {
+	if self.bad[self.pos] {
+		self.numBad--
+	}
+	self.bad[self.pos] = bad
+	if bad {
+		self.numBad++
+	}
+
+	self.pos = (self.pos + 1) % len(self.bad)
+	if self.pos == 0 {
+		self.filled = true
+	}
+}
+
+// The number of lines in the window
+func (self *errorWindow) numLines() int {
+	if self.filled {
+		return len(self.bad)
+	}
+	return self.pos
+}
+
+// Does the percentage of bad lines exceed the given limit? This is
+// always false until enough lines have been seen.
+func (self *errorWindow) exceeds(maxPercent int) bool {
+	numLines := self.numLines()
+	if numLines < kErrorRateMinLines {
+		return false
 	}
+	return self.numBad*100 > maxPercent*numLines
 }
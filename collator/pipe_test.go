@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package collator
+
+import (
+	"context"
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+func (s *MySuite) TestNamedPipe(c *C) {
+	pipe := filepath.Join(s.tmpDir, "TestNamedPipe")
+	c.Assert(syscall.Mkfifo(pipe, 0666), IsNil)
+
+	// The format is detected from the first line, as a pipe cannot be read twice
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{pipe},
+		AlertThreshold: 10,
+	})
+	c.Assert(err, IsNil)
+
+	// Opening a pipe waits for the reader
+	writer, err := os.OpenFile(pipe, os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	defer writer.Close()
+	for i := 0; i < 2; i++ {
+		_, err = writer.WriteString(`127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326 "-" "curl/7.35.0"` + "\n")
+		c.Assert(err, IsNil)
+	}
+
+	var total int
+	_, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		return total == 2
+	})
+	c.Assert(err, IsNil)
+	c.Check(total, Equals, 2)
+}
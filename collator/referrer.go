@@ -0,0 +1,44 @@
+package collator
+
+import (
+	"net/url"
+	"strings"
+)
+
+const (
+	// How many referrers are sent in Sites
+	kTopReferrers = 20
+
+	// How many different referrers are counted at once
+	kMaxReferrers = 10000
+)
+
+// Make the internal domains easy to compare with hosts.
+func internalDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+// Count the domain of the referrer of a hit, unless it is one of the
+// internal domains, or one of their subdomains.
+func (self *Collator) countReferrer(referrer *url.URL) {
+	if referrer == nil {
+		return
+	}
+	host := strings.TrimSuffix(strings.ToLower(referrer.Hostname()), ".")
+	if host == "" {
+		return
+	}
+	for _, domain := range self.internalDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return
+		}
+	}
+	self.referrerHits.add(host)
+}
@@ -0,0 +1,33 @@
+package collator
+
+import (
+	. "gopkg.in/check.v1"
+	"net/url"
+)
+
+func (s *MySuite) TestReferrers(c *C) {
+	collator := &Collator{
+		referrerHits:    newHeavyHitters(kMaxReferrers),
+		internalDomains: internalDomains([]string{"Example.com.", ""}),
+	}
+	for _, referrer := range []string{
+		"https://www.google.com/search?q=logs",
+		"https://WWW.Google.com:443/",
+		"https://news.ycombinator.com/item?id=1",
+		"https://example.com/about",
+		"https://blog.example.com/",
+		"https://notexample.com/",
+		"/relative",
+	} {
+		u, err := url.Parse(referrer)
+		c.Assert(err, IsNil)
+		collator.countReferrer(u)
+	}
+	collator.countReferrer(nil)
+
+	c.Check(collator.referrerHits.top(kTopReferrers), DeepEquals, []Count{
+		{"www.google.com", 2},
+		{"news.ycombinator.com", 1},
+		{"notexample.com", 1},
+	})
+}
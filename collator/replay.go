@@ -0,0 +1,92 @@
+package collator
+
+import (
+	"context"
+	"time"
+)
+
+// The simulated clock of a replay. It is advanced by the times of the log
+// entries, instead of by the wall clock.
+type replayClock struct {
+	// How many times faster than real time to replay; 0 for as fast as possible
+	speed int
+
+	// The times of the next Status and Sites, in log time
+	nextTick  time.Time
+	nextSites time.Time
+
+	// When the replay started, in log time and in wall-clock time
+	logStart  time.Time
+	wallStart time.Time
+}
+
+func newReplayClock(speed int) *replayClock {
+	return &replayClock{speed: speed}
+}
+
+// Advance the simulated clock to the time of a log entry, sending every
+// Status and Sites that falls due on the way. At a limited speed, this
+// waits until it is time to send them. It returns false if the Collator is
+// stopped while waiting.
+func (self *Collator) advanceReplay(ctx context.Context, t time.Time) bool {
+	clock := self.replayClock
+	if t.IsZero() {
+		return true
+	}
+
+	if clock.nextTick.IsZero() {
+		// The first entry starts the clock
+		clock.logStart = t.Truncate(kMovingAverageTimerDuration)
+		clock.wallStart = time.Now()
+		clock.nextTick = clock.logStart.Add(kMovingAverageTimerDuration)
+		clock.nextSites = clock.logStart.Add(kSitesTimerDuration)
+		return true
+	}
+
+	for !t.Before(clock.nextTick) {
+		if !clock.wait(ctx, clock.nextTick) {
+			return false
+		}
+		self.tick(clock.nextTick)
+		if !clock.nextTick.Before(clock.nextSites) {
+			self.sendSites()
+			clock.nextSites = clock.nextSites.Add(kSitesTimerDuration)
+		}
+		clock.nextTick = clock.nextTick.Add(kMovingAverageTimerDuration)
+	}
+	return true
+}
+
+// At the end of the replay, send the Status for the last, partial, second,
+// and the Sites.
+func (self *Collator) finishReplay() {
+	clock := self.replayClock
+	if clock.nextTick.IsZero() {
+		// There were no entries
+		return
+	}
+	self.tick(clock.nextTick)
+	self.sendSites()
+}
+
+// Wait until the wall clock catches up with the log time, at the speed of
+// the replay.
+func (self *replayClock) wait(ctx context.Context, logTime time.Time) bool {
+	if self.speed <= 0 {
+		return true
+	}
+	elapsed := logTime.Sub(self.logStart) / time.Duration(self.speed)
+	delay := self.wallStart.Add(elapsed).Sub(time.Now())
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
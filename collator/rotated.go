@@ -0,0 +1,203 @@
+package collator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The number that logrotate appends to a rotated log, before any .gz;
+// the higher the number, the older the log
+var rotationNumberRegexp = regexp.MustCompile(`\.(\d+)(\.gz)?$`)
+
+// The first bytes of a gzip file
+const kGzipMagic = "\x1f\x8b"
+
+// Expand the rotated log file names, which can be glob patterns, and sort
+// them oldest first: by their modification time, and then by their
+// rotation number, so access.log.2.gz comes before access.log.1.
+func expandRotated(patterns []string) ([]string, error) {
+	filenames, err := expandFilenames(patterns, false)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]os.FileInfo, len(filenames))
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		infos[filename] = info
+	}
+
+	sort.SliceStable(filenames, func(i, j int) bool {
+		a, b := infos[filenames[i]].ModTime(), infos[filenames[j]].ModTime()
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return rotationNumber(filenames[i]) > rotationNumber(filenames[j])
+	})
+	return filenames, nil
+}
+
+// The rotation number of a log file, or 0 if it has none
+func rotationNumber(filename string) int {
+	match := rotationNumberRegexp.FindStringSubmatch(filename)
+	if match == nil {
+		return 0
+	}
+	number, _ := strconv.Atoi(match[1])
+	return number
+}
+
+// Read the rotated logs, one after the other, and then start reading the
+// logs from their start, so that no lines are missed in between. Each
+// rotated log is forgotten once it has been read. Unless this is a replay,
+// the log is read up to now, and then tailed from there.
+func (self *Collator) _catchUp(ctx context.Context, rotated []string, filenames []string, lineChan chan<- *logLine) {
+	for _, filename := range rotated {
+		err := readLog(ctx, filename, lineChan)
+		if err != nil {
+			self.sendError(err)
+			return
+		}
+		select {
+		case lineChan <- &logLine{source: filename, closed: true}:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if self.config.Replay {
+		err := self.startLogs(ctx, filenames, true, lineChan)
+		if err != nil {
+			self.sendError(err)
+		}
+		return
+	}
+
+	pos, err := readUntilNow(ctx, filenames[0], lineChan)
+	if err != nil {
+		self.sendError(err)
+		return
+	}
+	select {
+	case lineChan <- &logLine{caughtUp: true}:
+	case <-ctx.Done():
+		return
+	}
+
+	// The tail resumes the log from there, as from a saved position; if it
+	// was rotated in the meantime, the new log is read from its start
+	self.savedPositions = map[string]*position{filenames[0]: pos}
+	err = self.startLogs(ctx, filenames, false, lineChan)
+	if err != nil {
+		self.sendError(err)
+	}
+}
+
+// Send the whole lines of a log file, and return its position after the
+// last one. A line that is still being written is left to the tail.
+func readUntilNow(ctx context.Context, filename string, lineChan chan<- *logLine) (*position, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pos := &position{}
+	pos.Device, pos.Inode = fileIdentity(info)
+
+	reader := bufio.NewReader(file)
+	for {
+		text, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return pos, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, filename)
+		}
+		select {
+		case lineChan <- &logLine{source: filename, text: strings.TrimSuffix(text, "\n")}:
+		case <-ctx.Done():
+			return pos, nil
+		}
+		pos.Offset += int64(len(text))
+	}
+}
+
+// Send every line of a log file, which may be compressed with gzip.
+func readLog(ctx context.Context, filename string, lineChan chan<- *logLine) error {
+	reader, err := openLog(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	err = readLines(ctx, filename, reader, lineChan)
+	if err != nil {
+		return errors.Wrap(err, filename)
+	}
+	return nil
+}
+
+// A log file, which is decompressed if it was compressed with gzip
+type logReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (self *logReader) Close() error {
+	return self.file.Close()
+}
+
+// Open a log file, decompressing it if it was compressed with gzip.
+func openLog(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(len(kGzipMagic)); string(magic) != kGzipMagic {
+		return &logReader{reader, file}, nil
+	}
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, filename)
+	}
+	return &logReader{gzipReader, file}, nil
+}
+
+// Send every line from a reader, until it ends.
+func readLines(ctx context.Context, source string, r io.Reader, lineChan chan<- *logLine) error {
+	reader := bufio.NewReader(r)
+	for {
+		text, err := reader.ReadString('\n')
+		if text != "" {
+			select {
+			case lineChan <- &logLine{source: source, text: strings.TrimSuffix(text, "\n")}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package collator
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// How many routes are sent in Sites
+	kTopRoutes = 50
+
+	// How many different routes are counted, so that the paths that
+	// aren't normalized cannot use up all the memory
+	kMaxRoutes = 10000
+)
+
+// A pattern for a segment of a path which is an identifier, and the name
+// that it is replaced by in the route
+type routePattern struct {
+	re   *regexp.Regexp
+	name string
+}
+
+// The identifiers that are known without being told
+var builtinRoutePatterns = []routePattern{
+	{regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`), ":uuid"},
+	{regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`), ":date"},
+	{regexp.MustCompile(`^\d+$`), ":id"},
+	{regexp.MustCompile(`^[0-9a-fA-F]{16,}$`), ":hash"},
+}
+
+// The route normalizer turns a path into its route, by replacing the
+// segments which are identifiers, such as /users/12345, with a name for
+// them, such as /users/:id.
+type routeNormalizer struct {
+	patterns []routePattern
+}
+
+// Create a route normalizer, with patterns of the form REGEXP=NAME, which
+// are tried before the built-in ones. The REGEXP must match the whole
+// segment.
+func newRouteNormalizer(specs []string) (*routeNormalizer, error) {
+	self := &routeNormalizer{}
+	for _, spec := range specs {
+		equals := strings.LastIndex(spec, "=")
+		if equals <= 0 || equals == len(spec)-1 {
+			return nil, errors.Errorf("Route pattern %s is not REGEXP=NAME", spec)
+		}
+		re, err := regexp.Compile("^(?:" + spec[:equals] + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "Route pattern %s", spec)
+		}
+		self.patterns = append(self.patterns, routePattern{re, spec[equals+1:]})
+	}
+	self.patterns = append(self.patterns, builtinRoutePatterns...)
+	return self, nil
+}
+
+// Find the route of a path.
+func (self *routeNormalizer) normalize(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		for _, pattern := range self.patterns {
+			if pattern.re.MatchString(segment) {
+				segments[i] = pattern.name
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,31 @@
+package collator
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRouteNormalizer(c *C) {
+	routes, err := newRouteNormalizer([]string{`[A-Z]{2}\d{6}=:order`})
+	c.Assert(err, IsNil)
+
+	tests := map[string]string{
+		"/users/12345/orders/9f8e7d6c-5b4a-4321-8765-0fedcba98765": "/users/:id/orders/:uuid",
+		"/reports/2017-05-04/":        "/reports/:date/",
+		"/blobs/0123456789abcdef0123": "/blobs/:hash",
+		"/orders/AB123456":            "/orders/:order",
+		"/orders/AB1234567":           "/orders/AB1234567",
+		"/":                           "/",
+		"/about":                      "/about",
+	}
+	for path, expected := range tests {
+		c.Check(routes.normalize(path), Equals, expected, Commentf("%s", path))
+	}
+
+	_, err = newRouteNormalizer([]string{`\d+`})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestTopCounts(c *C) {
+	counts := topCounts(map[string]int{"a": 1, "b": 3, "c": 3, "d": 2}, 3)
+	c.Check(counts, DeepEquals, []Count{{"b", 3}, {"c", 3}, {"d", 2}})
+}
@@ -0,0 +1,243 @@
+package collator
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// The names of the alert rules, which are sent in each Alert
+	kHitsRule        = "hits"
+	kServerErrorRule = "5xx-rate"
+	kClientErrorRule = "4xx-rate"
+	kBandwidthRule   = "bandwidth"
+	kLatencyRule     = "p99-latency"
+
+	// The defaults for the error rate rules
+	kDefaultErrorRateWindow  = time.Minute
+	kDefaultErrorRateMinHits = 100
+
+	// The default for the latency rule
+	kDefaultLatencyWindow = 30 * time.Second
+)
+
+// The counts of one second of a log, or of all of them together, which
+// the alert rules are checked against
+type second struct {
+	hits    int
+	average float64
+	classes [kStatusClasses]int
+
+	// The bytes sent, and their 2-minute moving average
+	bytes        int64
+	averageBytes float64
+
+	// The hits by the kind of their user agent
+	agents [kAgentKinds]int
+
+	// The latency of the requests
+	latency Latency
+}
+
+// An alertRule decides, second by second, whether to alert. Each log has
+// its own rules, as the rules remember the last seconds.
+type alertRule interface {
+	// The name of the rule
+	name() string
+
+	// Add the counts of a second, and tell whether the rule is broken,
+	// and why. If known is false, there is not enough traffic to tell,
+	// and the alert state does not change.
+	check(s *second) (broken bool, known bool, reason string)
+}
+
+// The alert rules, as configured, for a new log
+func (self *Collator) newRules() []alertRule {
+	window := int(self.config.ErrorRateWindow / time.Second)
+	if window <= 0 {
+		window = int(kDefaultErrorRateWindow / time.Second)
+	}
+	minHits := self.config.ErrorRateMinHits
+	if minHits <= 0 {
+		minHits = kDefaultErrorRateMinHits
+	}
+
+	var rules []alertRule
+	if self.config.BandwidthThreshold > 0 {
+		rules = append(rules, &bandwidthRule{float64(self.config.BandwidthThreshold)})
+	}
+	if self.config.ServerErrorPercent > 0 {
+		rules = append(rules, newErrorRateRule(kServerErrorRule, 5, self.config.ServerErrorPercent, window, minHits))
+	}
+	if self.config.ClientErrorPercent > 0 {
+		rules = append(rules, newErrorRateRule(kClientErrorRule, 4, self.config.ClientErrorPercent, window, minHits))
+	}
+	if self.config.LatencyThreshold > 0 {
+		latencyWindow := int(self.config.LatencyWindow / time.Second)
+		if latencyWindow <= 0 {
+			latencyWindow = int(kDefaultLatencyWindow / time.Second)
+		}
+		rules = append(rules, &latencyRule{threshold: self.config.LatencyThreshold, window: latencyWindow})
+	}
+	return rules
+}
+
+// Check the rules of a log against its last second, and send an Alert for
+// each rule that was broken, or recovered.
+func (self *Collator) checkRules(now time.Time, source string, c *counters, s *second) {
+	for i, rule := range c.rules {
+		broken, known, reason := rule.check(s)
+		if !known || broken == c.rulesBroken[i] {
+			continue
+		}
+		c.rulesBroken[i] = broken
+		self.AlertChan <- &Alert{
+			InAlertState:         broken,
+			AverageHitsPerSecond: s.average,
+			Time:                 now,
+			Source:               source,
+			Rule:                 rule.name(),
+			Reason:               reason,
+		}
+	}
+}
+
+// Send a recovery for every alert on a log that has ended, as its rules
+// will not be checked again.
+func (self *Collator) recoverAlerts(now time.Time, source string, c *counters) {
+	const reason = "the log has ended"
+	avg := c.hitsMovingAverage.Avg()
+	if c.inAlertedState {
+		self.AlertChan <- &Alert{false, avg, now, source, kHitsRule, reason}
+		c.inAlertedState = false
+	}
+	for i, rule := range c.rules {
+		if !c.rulesBroken[i] {
+			continue
+		}
+		c.rulesBroken[i] = false
+		self.AlertChan <- &Alert{
+			InAlertState:         false,
+			AverageHitsPerSecond: avg,
+			Time:                 now,
+			Source:               source,
+			Rule:                 rule.name(),
+			Reason:               reason,
+		}
+	}
+}
+
+// A sum over the last few seconds
+type slidingSum struct {
+	values []int
+	next   int
+	sum    int
+}
+
+func newSlidingSum(seconds int) *slidingSum {
+	return &slidingSum{values: make([]int, seconds)}
+}
+
+// Add the value of the latest second, which replaces the oldest one
+func (self *slidingSum) add(value int) {
+	self.sum += value - self.values[self.next]
+	self.values[self.next] = value
+	self.next = (self.next + 1) % len(self.values)
+}
+
+// Alert when the share of the hits with a class of status, over a window
+// of seconds, is above a percentage
+type errorRateRule struct {
+	ruleName string
+	class    int
+	percent  int
+	minHits  int
+	window   int
+
+	hits   *slidingSum
+	errors *slidingSum
+}
+
+func newErrorRateRule(name string, statusDigit int, percent int, window int, minHits int) *errorRateRule {
+	class, _ := statusClass(statusDigit * 100)
+	return &errorRateRule{
+		ruleName: name,
+		class:    class,
+		percent:  percent,
+		minHits:  minHits,
+		window:   window,
+		hits:     newSlidingSum(window),
+		errors:   newSlidingSum(window),
+	}
+}
+
+func (self *errorRateRule) name() string {
+	return self.ruleName
+}
+
+func (self *errorRateRule) check(s *second) (bool, bool, string) {
+	self.hits.add(s.hits)
+	self.errors.add(s.classes[self.class])
+	if self.hits.sum < self.minHits {
+		// Too few hits to alert on, but an alert is over, as the traffic
+		// that set it off has gone
+		return false, true, fmt.Sprintf("only %d hits over %ds", self.hits.sum, self.window)
+	}
+
+	rate := 100 * float64(self.errors.sum) / float64(self.hits.sum)
+	reason := fmt.Sprintf("%dxx in %.1f%% of %d hits over %ds", self.class+2, rate, self.hits.sum, self.window)
+	return rate > float64(self.percent), true, reason
+}
+
+// Alert when the 2-minute moving average of the bytes sent per second is
+// above a threshold
+type bandwidthRule struct {
+	threshold float64
+}
+
+func (self *bandwidthRule) name() string {
+	return kBandwidthRule
+}
+
+func (self *bandwidthRule) check(s *second) (bool, bool, string) {
+	reason := fmt.Sprintf("%.0f bytes/s over 2 minutes", s.averageBytes)
+	return s.averageBytes > self.threshold, true, reason
+}
+
+// Alert when the 99th percentile of the latency stays above a threshold for
+// a window of seconds, and recover when it stays below it for as long. The
+// seconds without requests, or whose requests have no duration, are skipped.
+type latencyRule struct {
+	threshold time.Duration
+	window    int
+
+	// How many of the last seconds were above the threshold, or were not
+	above int
+	below int
+}
+
+func (self *latencyRule) name() string {
+	return kLatencyRule
+}
+
+func (self *latencyRule) check(s *second) (bool, bool, string) {
+	if s.latency.Hits == 0 {
+		return false, false, ""
+	}
+	if s.latency.P99 > self.threshold {
+		self.above++
+		self.below = 0
+	} else {
+		self.below++
+		self.above = 0
+	}
+
+	switch {
+	case self.above >= self.window:
+		return true, true, fmt.Sprintf("p99 of %s, above %s for %ds", s.latency.P99, self.threshold, self.above)
+	case self.below >= self.window:
+		return false, true, fmt.Sprintf("p99 of %s, within %s for %ds", s.latency.P99, self.threshold, self.below)
+	default:
+		return false, false, ""
+	}
+}
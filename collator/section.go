@@ -0,0 +1,130 @@
+package collator
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The section of the paths that no rule matches, and that have no
+	// more segments than the section depth, such as / or /favicon.ico
+	kDefaultRootSection = "/"
+)
+
+// A rule which finds the section of a path, if it matches the path
+type sectionRule func(path string) (string, bool)
+
+// The rules which find the section of each path. The rules are tried in
+// order; if none match, the section is the first depth segments of the
+// path, or the root section if the path has no more than that.
+type sectionRules struct {
+	rules []sectionRule
+	depth int
+	root  string
+}
+
+func newSectionRules(config *Config) (*sectionRules, error) {
+	self := &sectionRules{
+		depth: config.SectionDepth,
+		root:  config.RootSection,
+	}
+	if self.depth <= 0 {
+		self.depth = 1
+	}
+	if self.root == "" {
+		self.root = kDefaultRootSection
+	}
+	for _, spec := range config.SectionRules {
+		rule, err := parseSectionRule(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Section rule %s", spec)
+		}
+		self.rules = append(self.rules, rule)
+	}
+	return self, nil
+}
+
+// Parse a section rule, which is one of:
+//
+//	/PREFIX[=NAME] - paths that start with the segments of PREFIX, where
+//	                 a * segment matches any segment; the section is NAME,
+//	                 or else the part of the path that matched
+//	~REGEXP[=NAME] - paths that match REGEXP; the section is NAME, in which
+//	                 $1 or ${name} are replaced by the submatches, or else
+//	                 the first submatch, or else the match
+func parseSectionRule(spec string) (sectionRule, error) {
+	pattern, name := spec, ""
+	if equals := strings.LastIndex(spec, "="); equals >= 0 {
+		pattern, name = spec[:equals], spec[equals+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+		return prefixRule(pattern, name), nil
+	case strings.HasPrefix(pattern, "~"):
+		return regexpRule(pattern[1:], name)
+	default:
+		return nil, errors.New("A rule must start with / for a prefix, or ~ for a regular expression")
+	}
+}
+
+func prefixRule(prefix string, name string) sectionRule {
+	prefixSegments := pathSegments(prefix)
+	return func(path string) (string, bool) {
+		segments := pathSegments(path)
+		if len(segments) < len(prefixSegments) {
+			return "", false
+		}
+		for i, prefixSegment := range prefixSegments {
+			if prefixSegment != "*" && prefixSegment != segments[i] {
+				return "", false
+			}
+		}
+		if name != "" {
+			return name, true
+		}
+		return "/" + strings.Join(segments[:len(prefixSegments)], "/"), true
+	}
+}
+
+func regexpRule(pattern string, name string) (sectionRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(path string) (string, bool) {
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			return "", false
+		}
+		switch {
+		case name != "":
+			return string(re.ExpandString(nil, name, path, match)), true
+		case len(match) > 2 && match[2] >= 0:
+			return path[match[2]:match[3]], true
+		default:
+			return path[match[0]:match[1]], true
+		}
+	}, nil
+}
+
+// Find the section of a path.
+func (self *sectionRules) find(path string) string {
+	for _, rule := range self.rules {
+		if section, ok := rule(path); ok {
+			return section
+		}
+	}
+
+	segments := pathSegments(path)
+	if len(segments) <= self.depth {
+		return self.root
+	}
+	return "/" + strings.Join(segments[:self.depth], "/")
+}
+
+// Split a path into its segments, after the leading slash
+func pathSegments(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
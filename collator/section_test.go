@@ -0,0 +1,45 @@
+package collator
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestSectionRules(c *C) {
+	sections, err := newSectionRules(&Config{
+		SectionRules: []string{
+			"/api/v1/users/*=users-api",
+			"/api/*/*",
+			`~^/static/(\w+)/`,
+			`~^/shop/(?P<kind>\w+)/\d+$=shop-${kind}`,
+		},
+		RootSection: "root",
+	})
+	c.Assert(err, IsNil)
+
+	tests := map[string]string{
+		"/api/v1/users/12345":  "users-api",
+		"/api/v1/users":        "/api/v1/users",
+		"/api/v2/orders/1":     "/api/v2/orders",
+		"/static/css/site.css": "css",
+		"/shop/books/123":      "shop-books",
+		"/shop/books/abc":      "/shop",
+		"/a/b":                 "/a",
+		"/a/":                  "/a",
+		"/favicon.ico":         "root",
+		"/":                    "root",
+	}
+	for path, expected := range tests {
+		c.Check(sections.find(path), Equals, expected, Commentf("%s", path))
+	}
+
+	// Deeper sections
+	sections, err = newSectionRules(&Config{SectionDepth: 2})
+	c.Assert(err, IsNil)
+	c.Check(sections.find("/api/v1/users"), Equals, "/api/v1")
+	c.Check(sections.find("/api/v1"), Equals, "/")
+
+	_, err = newSectionRules(&Config{SectionRules: []string{"api=x"}})
+	c.Check(err, NotNil)
+	_, err = newSectionRules(&Config{SectionRules: []string{"~(="}})
+	c.Check(err, NotNil)
+}
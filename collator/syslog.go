@@ -0,0 +1,314 @@
+package collator
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A log name with this prefix is a local address on which to listen
+	// for syslog messages, over both UDP and TCP; e.g. syslog://:5514
+	kSyslogScheme = "syslog://"
+
+	// The prefix of the source of each syslog message, which is followed
+	// by the tag and the host that sent it
+	kSyslogSource = "syslog:"
+
+	// The largest UDP datagram
+	kMaxDatagramSize = 65535
+)
+
+// The parts of a syslog message that matter to us
+type syslogMessage struct {
+	host string
+	tag  string
+	text string
+}
+
+// The log source of a syslog message, e.g. "syslog:nginx@web1"
+func (self *syslogMessage) source() string {
+	host, tag := self.host, self.tag
+	if host == "" {
+		host = "-"
+	}
+	if tag == "" {
+		tag = "-"
+	}
+	return kSyslogSource + tag + "@" + host
+}
+
+// Listen for syslog messages, and send the access log line in each of them.
+// The returned channel is closed when the listening stops.
+func (self *Collator) startSyslog(ctx context.Context, name string, lineChan chan<- *logLine) (<-chan struct{}, error) {
+	address := strings.TrimPrefix(name, kSyslogScheme)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Listening for syslog on %s", address)
+	}
+
+	// Listen for UDP on the same port, in case the port was chosen
+	// for us
+	host, _, _ := net.SplitHostPort(address)
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	packetConn, err := net.ListenPacket("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "Listening for syslog on %s", address)
+	}
+	self.listenAddrs[name] = listener.Addr()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	sources := newListenerSources(kSyslogSource)
+	go self._syslogUDP(ctx, packetConn, sources, lineChan, &wg)
+	go self._syslogTCP(ctx, listener, sources, lineChan, &wg)
+
+	// Stop listening when the Collator stops
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		packetConn.Close()
+		listener.Close()
+		wg.Wait()
+		close(done)
+	}()
+	return done, nil
+}
+
+// Read syslog messages, one per datagram.
+func (self *Collator) _syslogUDP(ctx context.Context, conn net.PacketConn, sources *listenerSources, lineChan chan<- *logLine, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buffer := make([]byte, kMaxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() == nil {
+				self.sendError(errors.Wrap(err, "Reading syslog"))
+			}
+			return
+		}
+		if !sendSyslog(ctx, string(buffer[:n]), sources, lineChan) {
+			return
+		}
+	}
+}
+
+// Accept syslog connections.
+func (self *Collator) _syslogTCP(ctx context.Context, listener net.Listener, sources *listenerSources, lineChan chan<- *logLine, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				self.sendError(errors.Wrap(err, "Accepting syslog connections"))
+			}
+			return
+		}
+		go _syslogConn(ctx, conn, sources, lineChan)
+	}
+}
+
+// Read the syslog messages from one connection, until it is closed. The
+// messages are framed either by octet counting or by newlines (RFC 6587).
+func _syslogConn(ctx context.Context, conn net.Conn, sources *listenerSources, lineChan chan<- *logLine) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+
+	// Don't keep the connection open after the Collator stops
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readSyslogFrame(reader)
+		if frame != "" && !sendSyslog(ctx, frame, sources, lineChan) {
+			return
+		}
+		if err != nil {
+			// A broken connection only loses its own messages
+			return
+		}
+	}
+}
+
+// Read one syslog message from a stream.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		// Framed by a newline
+		frame, err := reader.ReadString('\n')
+		if err == io.EOF {
+			err = nil
+			if frame == "" {
+				err = io.EOF
+			}
+		}
+		return frame, err
+	}
+
+	// Framed by the length of the message, followed by a space
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || n > kMaxDatagramSize {
+		return "", errors.Errorf("Bad syslog message length %q", length)
+	}
+	frame := make([]byte, n)
+	_, err = io.ReadFull(reader, frame)
+	if err != nil {
+		return "", err
+	}
+	return string(frame), nil
+}
+
+// Send the line in a syslog message, under the source that it names, if
+// there is room for it. It returns false if the Collator is stopped while
+// waiting.
+func sendSyslog(ctx context.Context, frame string, sources *listenerSources, lineChan chan<- *logLine) bool {
+	message := parseSyslog(frame)
+	select {
+	case lineChan <- &logLine{source: sources.find(message.source()), text: message.text}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Parse a syslog message, in either the BSD format (RFC 3164), e.g.
+//
+//	<190>Feb 10 13:55:36 web1 nginx: 127.0.0.1 - - ...
+//
+// or the newer format (RFC 5424), e.g.
+//
+//	<190>1 2015-02-10T13:55:36Z web1 nginx - - - 127.0.0.1 - - ...
+//
+// Anything that isn't syslog is taken as a message by itself.
+func parseSyslog(frame string) *syslogMessage {
+	frame = strings.TrimRight(frame, "\r\n\x00")
+
+	// The priority
+	if !strings.HasPrefix(frame, "<") {
+		return &syslogMessage{text: frame}
+	}
+	end := strings.IndexByte(frame, '>')
+	if end < 2 || end > 4 {
+		return &syslogMessage{text: frame}
+	}
+	if _, err := strconv.Atoi(frame[1:end]); err != nil {
+		return &syslogMessage{text: frame}
+	}
+	rest := frame[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		return parseSyslog5424(rest[2:])
+	}
+	return parseSyslog3164(rest)
+}
+
+// Parse what follows the priority of an RFC 3164 message.
+func parseSyslog3164(rest string) *syslogMessage {
+	message := &syslogMessage{}
+
+	// The timestamp, and the host, are not always there
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			rest = rest[len(time.Stamp)+1:]
+			if space := strings.IndexByte(rest, ' '); space > 0 {
+				message.host = rest[:space]
+				rest = rest[space+1:]
+			}
+		}
+	}
+
+	// The tag, which may have a process ID, ends with a colon
+	if colon := strings.Index(rest, ": "); colon > 0 && !strings.ContainsAny(rest[:colon], " \t") {
+		tag := rest[:colon]
+		if bracket := strings.IndexByte(tag, '['); bracket > 0 {
+			tag = tag[:bracket]
+		}
+		message.tag = tag
+		rest = rest[colon+2:]
+	}
+
+	message.text = rest
+	return message
+}
+
+// Parse what follows the version of an RFC 5424 message.
+func parseSyslog5424(rest string) *syslogMessage {
+	// The timestamp, host, app name, process ID and message ID
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 6 {
+		return &syslogMessage{text: rest}
+	}
+	message := &syslogMessage{
+		host: nilValue(fields[1]),
+		tag:  nilValue(fields[2]),
+	}
+	rest = fields[5]
+
+	// The structured data
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		for strings.HasPrefix(rest, "[") {
+			end := structuredDataEnd(rest)
+			if end < 0 {
+				break
+			}
+			rest = rest[end+1:]
+		}
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	message.text = strings.TrimPrefix(rest, "\xef\xbb\xbf") // the byte order mark
+	return message
+}
+
+// Find the closing bracket of a structured data element, skipping those
+// in its quoted values.
+func structuredDataEnd(s string) int {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ']':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// RFC 5424 writes a missing value as "-"
+func nilValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,104 @@
+package collator
+
+import (
+	"context"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net"
+	"strconv"
+	"time"
+)
+
+func (s *MySuite) TestParseSyslog(c *C) {
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	tests := []struct {
+		frame    string
+		expected syslogMessage
+	}{
+		{"<190>Feb 10 13:55:36 web1 nginx: " + line + "\n", syslogMessage{"web1", "nginx", line}},
+		{"<190>Feb  9 13:55:36 web1 nginx[123]: " + line, syslogMessage{"web1", "nginx", line}},
+		{"<190>nginx: " + line, syslogMessage{"", "nginx", line}},
+		{"<190>1 2015-02-10T13:55:36Z web1 nginx - - - " + line, syslogMessage{"web1", "nginx", line}},
+		{`<190>1 2015-02-10T13:55:36Z web1 nginx 123 access [a@1 b="x\"]"][c@1] ` + line, syslogMessage{"web1", "nginx", line}},
+		{line, syslogMessage{"", "", line}},
+	}
+	for _, test := range tests {
+		c.Check(*parseSyslog(test.frame), Equals, test.expected, Commentf("%s", test.frame))
+	}
+}
+
+func (s *MySuite) TestSyslog(c *C) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{kSyslogScheme + "127.0.0.1:0"},
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+	address := m.listenAddrs[kSyslogScheme+"127.0.0.1:0"].String()
+
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	udp, err := net.Dial("udp", address)
+	c.Assert(err, IsNil)
+	defer udp.Close()
+	_, err = udp.Write([]byte("<190>Feb 10 13:55:36 web1 nginx: " + line))
+	c.Assert(err, IsNil)
+
+	// Over TCP, with both kinds of framing
+	tcp, err := net.Dial("tcp", address)
+	c.Assert(err, IsNil)
+	defer tcp.Close()
+	frame := "<190>Feb 10 13:55:36 web2 nginx: " + line
+	_, err = tcp.Write([]byte(frame + "\n" + strconv.Itoa(len(frame)) + " " + frame))
+	c.Assert(err, IsNil)
+
+	bySource := make(map[string]int)
+	var total int
+	_, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		for source, sourceStatus := range status.BySource {
+			bySource[source] += sourceStatus.HitsLastSecond
+		}
+		return total == 3
+	})
+	c.Assert(err, IsNil)
+	c.Check(bySource, DeepEquals, map[string]int{"syslog:nginx@web1": 1, "syslog:nginx@web2": 2})
+}
+
+func (s *MySuite) TestSyslogSources(c *C) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	m, err := NewAndRun(ctx, &Config{
+		Filenames:      []string{kSyslogScheme + "127.0.0.1:0"},
+		AlertThreshold: 10,
+		Format:         "common",
+	})
+	c.Assert(err, IsNil)
+	address := m.listenAddrs[kSyslogScheme+"127.0.0.1:0"].String()
+
+	// Each message names a new host, until there are too many of them
+	line := `127.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /a/b HTTP/1.0" 200 2326`
+	tcp, err := net.Dial("tcp", address)
+	c.Assert(err, IsNil)
+	defer tcp.Close()
+	messages := kMaxListenerSources + 2
+	for i := 0; i < messages; i++ {
+		_, err = fmt.Fprintf(tcp, "<190>Feb 10 13:55:36 web%d nginx: %s\n", i, line)
+		c.Assert(err, IsNil)
+	}
+
+	bySource := make(map[string]int)
+	var total int
+	_, err = getStatusWithTimeout(m, time.Duration(5)*time.Second, func(status *Status) bool {
+		total += status.HitsLastSecond
+		for source, sourceStatus := range status.BySource {
+			bySource[source] += sourceStatus.HitsLastSecond
+		}
+		return total == messages
+	})
+	c.Assert(err, IsNil)
+	c.Check(bySource, HasLen, kMaxListenerSources+1)
+	c.Check(bySource["syslog:nginx@web0"], Equals, 1)
+	c.Check(bySource[kSyslogSource+kOther], Equals, 2)
+}
@@ -3,46 +3,246 @@ package collator
 import (
 	"context"
 	"github.com/hpcloud/tail"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+// The file name which stands for the standard input
+const kStdin = "-"
+
 // see https://stackoverflow.com/questions/10135738/reading-log-files-as-theyre-updated-in-go
 
-func (self *Collator) startTail(ctx context.Context, filename string, lineChan chan<- string) error {
-	var err error
-	self.tailer, err = tail.TailFile(filename, tail.Config{
-		Follow:   true,                  // monitor for new lines (tail -f)
-		ReOpen:   true,                  // re-open recreated files (taile -F)
-		Location: &tail.SeekInfo{0, 2},  // start at the very end of the file
-		Logger:   tail.DiscardingLogger, // we don't want logging to go to the console
-	})
+// A line of text, and the log file it came from. A logLine with closed set
+// has no text, and says that the log file is no longer being read. One with
+// caughtUp set has neither, and says that the rotated logs, and the log,
+// have been replayed, and that the log is now tailed.
+type logLine struct {
+	source   string
+	text     string
+	closed   bool
+	caughtUp bool
+}
+
+// Expand the file names, which can be glob patterns, into the list of log
+// files to monitor. It is an error for a pattern to match no files, unless
+// allowNoMatch is set.
+func expandFilenames(patterns []string, allowNoMatch bool) ([]string, error) {
+	var filenames []string
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		if !isFile(pattern) {
+			if !seen[pattern] {
+				seen[pattern] = true
+				filenames = append(filenames, pattern)
+			}
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad file pattern %s", pattern)
+		}
+		if len(matches) == 0 && !allowNoMatch {
+			return nil, errors.Errorf("Cannot read %s", pattern)
+		}
+		for _, filename := range matches {
+			if !seen[filename] {
+				seen[filename] = true
+				filenames = append(filenames, filename)
+			}
+		}
+	}
+	return filenames, nil
+}
+
+// Start tailing a file. If fromStart is set, the whole file is read;
+// otherwise only the lines added from now on are, unless there is a state
+// file, which says where to resume. A replay is not a tail: the whole file
+// is read, up to its end. The returned channel is closed when the tailing,
+// or reading, stops.
+//
+// The standard input and named pipes are streams, which are read from
+// wherever they are, and cannot be resumed.
+func (self *Collator) startTail(ctx context.Context, filename string, fromStart bool, lineChan chan<- *logLine) (<-chan struct{}, error) {
+	if filename == kStdin {
+		done := make(chan struct{})
+		go self._readStdin(ctx, lineChan, done)
+		return done, nil
+	}
+	if strings.HasPrefix(filename, kSyslogScheme) {
+		return self.startSyslog(ctx, filename, lineChan)
+	}
+	if strings.HasPrefix(filename, kHTTPScheme) {
+		return self.startHTTP(ctx, filename, lineChan)
+	}
+
+	if self.config.Replay {
+		done := make(chan struct{})
+		go self._readLog(ctx, filename, lineChan, done)
+		return done, nil
+	}
+
+	pipe := isNamedPipe(filename)
+
+	// The position of a file is tracked to resume it, and to read the rest
+	// of it once it is rotated
+	var pos *position
+	var location *tail.SeekInfo // a pipe cannot seek
+	if !pipe {
+		var err error
+		pos, err = self.startPosition(filename, fromStart)
+		if err != nil {
+			return nil, err
+		}
+		location = &tail.SeekInfo{Offset: pos.Offset, Whence: 0}
+	}
+
+	tailer, err := tailFile(filename, location, pipe)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	go self._tail(ctx, lineChan)
-	return nil
+	// A watched file that is replaced is a new log, which the watch tails
+	reopen := !pipe && !self.config.Watch
+
+	done := make(chan struct{})
+	go self._tail(ctx, filename, tailer, pos, reopen, lineChan, done)
+	return done, nil
+}
+
+// Start a tail of a file, which stops once the file is replaced (rotated),
+// or removed, and it has read all of it. hpcloud/tail can reopen the file
+// by itself, but then it does not say which lines came from which file.
+// The file is polled, as the inotify watches of hpcloud/tail can miss a
+// file that is created, or written to, just as the tail starts.
+func tailFile(filename string, location *tail.SeekInfo, pipe bool) (*tail.Tail, error) {
+	return tail.TailFile(filename, tail.Config{
+		Follow:   true,     // monitor for new lines (tail -f)
+		Location: location, // where to start reading
+		Pipe:     pipe,     // a named pipe (mkfifo)
+		Poll:     !pipe,
+		Logger:   tail.DiscardingLogger, // we don't want logging to go to the console
+	})
 }
 
-// Watch (tail) the file and send one line of text when it is available
-func (self *Collator) _tail(ctx context.Context, lineChan chan<- string) {
-	defer close(lineChan)
+// Watch (tail) the file and send one line of text when it is available.
+// If pos is set, it is kept up to date with the lines that were sent. If
+// reopen is set, once the file is replaced (rotated) or removed, the rest
+// of it is read, and the file that takes its name is tailed from its start,
+// like tail -F.
+func (self *Collator) _tail(ctx context.Context, filename string, tailer *tail.Tail, pos *position,
+	reopen bool, lineChan chan<- *logLine, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		tailer.Stop() // this will ignore a possible error, but that's ok
+	}()
 
 	// "tail" the file
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case tailLine, ok := <-self.tailer.Lines:
+		case tailLine, ok := <-tailer.Lines:
 			if !ok {
-				err := self.tailer.Err()
-				if err != nil {
+				// The tail has stopped; wait for it to say why. The file
+				// may have been removed before it was watched for changes.
+				err := tailer.Wait()
+				if err != nil && !os.IsNotExist(err) {
 					// We encountered an error; notify the listener and abort
-					self.ErrorChan <- err
+					self.sendError(err)
+					return
+				}
+				if !reopen {
 					return
 				}
+
+				// The old file was replaced or removed
+				err = self.readRest(ctx, filename, pos, lineChan)
+				if err != nil {
+					self.sendError(err)
+					return
+				}
+				self.reopenPosition(filename, pos)
+				tailer, err = tailFile(filename, &tail.SeekInfo{Offset: 0, Whence: 0}, false)
+				if err != nil {
+					self.sendError(err)
+					return
+				}
+				continue
+			}
+			select {
+			case lineChan <- &logLine{source: filename, text: tailLine.Text}:
+			case <-ctx.Done():
 				return
 			}
-			lineChan <- tailLine.Text
+			if pos != nil {
+				self.advancePosition(filename, pos, tailLine.Text)
+			}
 		}
 	}
 }
+
+// Read the rest of a file which is no longer tailed, as it was replaced
+// (rotated) or removed. The tail stops once it notices that, but lines may
+// have been added after it last read the file, which is still open.
+func (self *Collator) readRest(ctx context.Context, filename string, pos *position, lineChan chan<- *logLine) error {
+	if pos.file == nil {
+		return nil
+	}
+	_, err := pos.file.Seek(pos.Offset, io.SeekStart)
+	if err == nil {
+		err = readLines(ctx, filename, pos.file, lineChan)
+	}
+	return errors.Wrapf(err, "Reading the rest of %s", filename)
+}
+
+// Read a whole log file, for a replay.
+func (self *Collator) _readLog(ctx context.Context, filename string, lineChan chan<- *logLine, done chan<- struct{}) {
+	defer close(done)
+
+	err := readLog(ctx, filename, lineChan)
+	if err != nil {
+		self.sendError(err)
+	}
+}
+
+// Read the standard input until it ends.
+func (self *Collator) _readStdin(ctx context.Context, lineChan chan<- *logLine, done chan<- struct{}) {
+	defer close(done)
+
+	err := readLines(ctx, kStdin, os.Stdin, lineChan)
+	if err != nil {
+		self.sendError(errors.Wrap(err, "Reading the standard input"))
+	}
+}
+
+// Is the log name that of a file (or a named pipe), instead of the standard
+// input or a network listener?
+func isFile(filename string) bool {
+	return filename != kStdin && !isListener(filename)
+}
+
+// Is the log name that of a network listener, whose lines come from
+// many senders?
+func isListener(filename string) bool {
+	return strings.HasPrefix(filename, kSyslogScheme) || strings.HasPrefix(filename, kHTTPScheme)
+}
+
+// Is the log a stream, such as the standard input, a named pipe, or the
+// messages from a network listener, which can only be read once, instead
+// of a file?
+func isStream(filename string) bool {
+	if filename == kStdin {
+		return true
+	}
+	info, err := os.Stat(filename)
+	return err != nil || !info.Mode().IsRegular()
+}
+
+func isNamedPipe(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
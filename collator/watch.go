@@ -0,0 +1,185 @@
+package collator
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gopkg.in/fsnotify.v1"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A log file found by watching a directory, which is being tailed
+type watchedFile struct {
+	// Stops the tailing
+	cancelFunc context.CancelFunc
+	// Closed when the tailing has stopped
+	done <-chan struct{}
+}
+
+// Tail the log files matching the patterns, and watch their directories,
+// to also tail matching files which are created later, and stop tailing
+// those which are removed. If fromStart is set, the files that exist now
+// are read from their start. If the directory of a pattern is itself a
+// pattern, the directories that match it now are watched; those created
+// later are not.
+func (self *Collator) startWatch(ctx context.Context, patterns []string, fromStart bool, lineChan chan<- *logLine) error {
+	cleanPatterns := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		cleanPatterns[i] = filepath.Clean(pattern)
+	}
+	patterns = cleanPatterns
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the directories first, so that no new file is missed
+	watchedDirs := make(map[string]bool)
+	for _, pattern := range patterns {
+		dirs, err := watchedDirectories(pattern)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		for _, dir := range dirs {
+			if watchedDirs[dir] {
+				continue
+			}
+			err = watcher.Add(dir)
+			if err != nil {
+				watcher.Close()
+				return errors.Wrapf(err, "Watching %s", dir)
+			}
+			watchedDirs[dir] = true
+		}
+	}
+
+	filenames, err := expandFilenames(patterns, true)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	// The files that exist now are tailed from their end, unless told otherwise
+	files := make(map[string]*watchedFile)
+	for _, filename := range filenames {
+		file, err := self.startWatchedTail(ctx, filename, fromStart, lineChan)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		files[filename] = file
+	}
+
+	go self._watch(ctx, watcher, patterns, files, lineChan)
+	return nil
+}
+
+// The directories to watch for the files matching a pattern: either its
+// directory, or those matching it, if it is a pattern too.
+func watchedDirectories(pattern string) ([]string, error) {
+	dir := filepath.Dir(pattern)
+	if !strings.ContainsAny(dir, "*?[") {
+		return []string{dir}, nil
+	}
+
+	matches, err := filepath.Glob(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad file pattern %s", pattern)
+	}
+	var dirs []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, errors.Errorf("No directories match %s, so it cannot be watched for", dir)
+	}
+	return dirs, nil
+}
+
+func (self *Collator) startWatchedTail(ctx context.Context, filename string, fromStart bool, lineChan chan<- *logLine) (*watchedFile, error) {
+	fileCtx, cancelFunc := context.WithCancel(ctx)
+	done, err := self.startTail(fileCtx, filename, fromStart, lineChan)
+	if err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	return &watchedFile{cancelFunc: cancelFunc, done: done}, nil
+}
+
+// Watch the directories for log files being created and removed.
+func (self *Collator) _watch(ctx context.Context, watcher *fsnotify.Watcher, patterns []string,
+	files map[string]*watchedFile, lineChan chan<- *logLine) {
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event := <-watcher.Events:
+			filename := filepath.Clean(event.Name)
+			if !matchesAny(patterns, filename) {
+				continue
+			}
+
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if file, has := files[filename]; has {
+					self.stopWatchedTail(ctx, filename, file, lineChan)
+					delete(files, filename)
+				}
+			}
+
+			if event.Op&fsnotify.Create != 0 {
+				// A file replaced by another with the same name is a new log
+				if file, has := files[filename]; has {
+					self.stopWatchedTail(ctx, filename, file, lineChan)
+				}
+				// A new file is read from its start, so no lines are missed
+				file, err := self.startWatchedTail(ctx, filename, true, lineChan)
+				if err != nil {
+					self.sendError(err)
+					return
+				}
+				files[filename] = file
+			}
+
+		case err := <-watcher.Errors:
+			self.sendError(errors.Wrap(err, "Watching for log files"))
+			return
+		}
+	}
+}
+
+// Stop tailing a file which was removed or replaced, read the rest of the
+// file, which the tail may not have read yet, and then tell the rest of the
+// pipeline that the log is gone.
+func (self *Collator) stopWatchedTail(ctx context.Context, filename string, file *watchedFile, lineChan chan<- *logLine) {
+	file.cancelFunc()
+	<-file.done
+	if pos := self.forgetPosition(filename); pos != nil {
+		err := self.readRest(ctx, filename, pos, lineChan)
+		pos.close()
+		if err != nil {
+			self.sendError(err)
+		}
+	}
+
+	select {
+	case lineChan <- &logLine{source: filename, closed: true}:
+	case <-ctx.Done():
+	}
+}
+
+func matchesAny(patterns []string, filename string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, filename); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -6,28 +6,199 @@ import (
 	"fmt"
 	"github.com/gilramir/argparse"
 	"github.com/gilramir/monitor-weblog/collator"
-	"github.com/pkg/errors"
+	"github.com/gilramir/monitor-weblog/xojoc/logparse"
 	"os"
+	"strings"
+	"time"
 )
 
 // These hold the values from the command line.
 type Options struct {
-	Filename       string
-	AlertThreshold int
+	Filename           string
+	AlertThreshold     int
+	File               []string
+	AlertPerFile       bool
+	Watch              bool
+	Format             string
+	LogFormat          string
+	Tolerant           bool
+	MaxErrorPercent    int
+	Replay             bool
+	ReplaySpeed        int
+	EventTime          bool
+	AllowedLateness    int
+	StateFile          string
+	Rotated            []string
+	Section            []string
+	SectionDepth       int
+	RootSection        string
+	RoutePattern       []string
+	ServerErrorPercent int
+	ClientErrorPercent int
+	ErrorRateWindow    int
+	ErrorRateMinHits   int
+	BandwidthThreshold int
+	ClientPrefixV4     int
+	ClientPrefixV6     int
+	AlertOnHumans      bool
+	InternalDomain     []string
+	LatencyThreshold   int
+	LatencyWindow      int
 }
 
 func main() {
 	// Create the argument parser
 	argumentParser := &argparse.ArgumentParser{
 		Name:             "monitor web-log",
-		ShortDescription: "Monitor logs in the Common Log format",
-		Destination:      &Options{},
+		ShortDescription: "Monitor web server logs",
+		Destination: &Options{Format: "auto", ReplaySpeed: 1, AllowedLateness: 5,
+			ErrorRateWindow: 60, ErrorRateMinHits: 100, LatencyWindow: 30},
 	}
 
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--file",
+		Help: "Another log file (or glob pattern) to monitor; can be given more than once",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--watch",
+		Help: "Also monitor log files that match the file patterns once they are created",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--alert-per-file",
+		Help: "Also alert on the traffic of each log file",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--format",
+		Help: "The log format: auto (the default), " + strings.Join(formatNames(), ", ") + ", apache, nginx",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--log-format",
+		Help: "The LogFormat string for --format=apache, the log_format for --format=nginx, or the field mapping for --format=json",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--tolerant",
+		Help: "Count lines that cannot be parsed, instead of stopping",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--max-error-percent",
+		Help: "With --tolerant, stop if more than this percent of recent lines cannot be parsed",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--replay",
+		Help: "Read the log files from their start, and replay them by the times of their entries",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--replay-speed",
+		Help: "With --replay, how many times faster than real time to replay; 0 is as fast as possible (default 1)",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--event-time",
+		Help: "Count hits in the second of their log entry, instead of the second they are read in",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--allowed-lateness",
+		Help: "With --event-time, how many seconds to wait for late entries (default 5)",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--state-file",
+		Help: "Save how far each log file was read to this file, and resume from there next time",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--rotated",
+		Help: "A rotated log file (or glob pattern), possibly gzipped, to replay before the log file, which is then tailed unless --replay; can be given more than once",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--section",
+		Help: "A rule for the section of a path: /PREFIX[=NAME] or ~REGEXP[=NAME]; can be given more than once",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--section-depth",
+		Help: "How many segments of a path that no rule matches make its section (default 1)",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--root-section",
+		Help: "The section of paths with no more segments than the depth, such as /favicon.ico (default /)",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--route-pattern",
+		Help: "REGEXP=NAME: path segments matching REGEXP are shown as NAME in the routes; can be given more than once",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--client-prefix-v4",
+		Help: "Group the IPv4 clients into subnets with this prefix length, e.g. 24",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--client-prefix-v6",
+		Help: "Group the IPv6 clients into subnets with this prefix length, e.g. 64",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--internal-domain",
+		Help: "One of our own domains, which is not shown as a referrer; can be given more than once",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--alert-on-humans",
+		Help: "Alert on the hits of browsers only, and not those of crawlers and scripts",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--server-error-percent",
+		Help: "Alert when more than this percent of the hits had a 5xx status",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--client-error-percent",
+		Help: "Alert when more than this percent of the hits had a 4xx status",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--bandwidth-threshold",
+		Help: "Alert when the 2-minute average of the bytes sent per second is above this",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--latency-threshold",
+		Help: "Alert when the 99th percentile of the latency, in milliseconds, stays above this",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--latency-window",
+		Help: "How many seconds the latency must stay above the threshold to alert, or below it to recover",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--error-rate-window",
+		Help: "How many seconds the error rates are measured over",
+	})
+
+	argumentParser.AddArgument(&argparse.Argument{
+		Long: "--error-rate-min-hits",
+		Help: "The error rates are not alerted on with fewer hits than this in the window",
+	})
+
 	// First positional argument
 	argumentParser.AddArgument(&argparse.Argument{
 		Name: "filename",
-		Help: "The log file to monitor",
+		Help: "The log file to monitor; this can be a glob pattern, a named pipe, - for the standard input, syslog://ADDRESS to listen for syslog, or http://ADDRESS/PATH to accept POSTed lines",
 	})
 
 	// Second positional argument
@@ -46,23 +217,60 @@ func main() {
 
 // Run the text UI, and report any error that happened
 func (self *Options) Run(parents []argparse.Destination) error {
-	// Ensure the file exists before starting.
-	if _, err := os.Stat(self.Filename); err != nil {
-		return errors.Errorf("Cannot read %s", self.Filename)
-	}
-
 	// Start the Collator
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	c, err := collator.NewAndRun(ctx, self.Filename, self.AlertThreshold)
+	c, err := collator.NewAndRun(ctx, &collator.Config{
+		Filenames:          append([]string{self.Filename}, self.File...),
+		AlertThreshold:     self.AlertThreshold,
+		AlertPerSource:     self.AlertPerFile,
+		Watch:              self.Watch,
+		Format:             self.Format,
+		LogFormat:          self.LogFormat,
+		Tolerant:           self.Tolerant,
+		MaxErrorPercent:    self.MaxErrorPercent,
+		Replay:             self.Replay,
+		ReplaySpeed:        self.ReplaySpeed,
+		EventTime:          self.EventTime,
+		AllowedLateness:    time.Duration(self.AllowedLateness) * time.Second,
+		StateFile:          self.StateFile,
+		Rotated:            self.Rotated,
+		SectionRules:       self.Section,
+		SectionDepth:       self.SectionDepth,
+		RootSection:        self.RootSection,
+		RoutePatterns:      self.RoutePattern,
+		ServerErrorPercent: self.ServerErrorPercent,
+		ClientErrorPercent: self.ClientErrorPercent,
+		ErrorRateWindow:    time.Duration(self.ErrorRateWindow) * time.Second,
+		ErrorRateMinHits:   self.ErrorRateMinHits,
+		BandwidthThreshold: int64(self.BandwidthThreshold),
+		ClientPrefixV4:     self.ClientPrefixV4,
+		ClientPrefixV6:     self.ClientPrefixV6,
+		AlertOnHumans:      self.AlertOnHumans,
+		InternalDomains:    self.InternalDomain,
+		LatencyThreshold:   time.Duration(self.LatencyThreshold) * time.Millisecond,
+		LatencyWindow:      time.Duration(self.LatencyWindow) * time.Second,
+	})
 	if err != nil {
+		cancelFunc()
 		return err
 	}
 
 	// Run the UI; this returns when the UI stops.
 	err = runUI(cancelFunc, c)
+
+	// Wait for the Collator to save its state
+	waitErr := c.Wait()
 	if err != nil {
 		return err
 	}
+	return waitErr
+}
 
-	return nil
+// The names of the log formats that can be given to --format
+func formatNames() []string {
+	var names []string
+	for _, format := range logparse.Formats() {
+		names = append(names, format.Name)
+	}
+	return names
 }
@@ -6,15 +6,30 @@ import (
 	"github.com/gilramir/monitor-weblog/collator"
 	"github.com/gizak/termui"
 	"github.com/pkg/errors"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // A container for the widgets we need to keep track of
 type widgetCollection struct {
-	sites  *termui.List
-	alerts *termui.List
-	hits   *termui.LineChart
-	avg    *termui.LineChart
+	sites     *termui.List
+	routes    *termui.List
+	clients   *termui.List
+	agents    *termui.List
+	referrers *termui.List
+	alerts    *termui.List
+	hits      *termui.LineChart
+	avg       *termui.LineChart
+	classes   *termui.MBarChart
+	bytes     *termui.LineChart
+	latency   *termui.LineChart
+
+	// The sites list can show all the logs together, or each log file
+	sitesBySource bool
+	lastSites     *collator.Sites
 }
 
 // Run the UI and return when it is stopped
@@ -77,16 +92,43 @@ func createUI() *widgetCollection {
 	// The widget holding the list of most visited sites
 	sitesWidget := termui.NewList()
 	sitesWidget.BorderLabel = "Highest Visited Sites"
+	// The widget holding the list of most visited routes
+	routesWidget := termui.NewList()
+	routesWidget.BorderLabel = "Top Routes"
+	// The widget holding the list of clients with the most hits
+	clientsWidget := termui.NewList()
+	clientsWidget.BorderLabel = "Top Clients"
+	// The widget holding the list of domains that referred the most hits
+	referrersWidget := termui.NewList()
+	referrersWidget.BorderLabel = "Top Referrers"
+	// The widget holding the lists of top browsers, operating systems, and crawlers
+	agentsWidget := termui.NewList()
+	agentsWidget.BorderLabel = kAgentsLabel
 	alertsWidget := termui.NewList()
 	alertsWidget.BorderLabel = "Recent Alerts"
 
 	// The widget holding the line chart of recent hits per second
 	hitsWidget := termui.NewLineChart()
 	hitsWidget.Mode = "dot"
-	hitsWidget.BorderLabel = "Hits Per Second"
+	hitsWidget.BorderLabel = kHitsLabel
 	hitsWidget.LineColor = termui.ColorYellow | termui.AttrBold
 	hitsWidget.DataLabels = make([]string, 0)
 
+	// The widget holding the stacked bar chart of recent hits per second by
+	// the class of their status: 2xx, 3xx, 4xx, and 5xx from the bottom up
+	classesWidget := termui.NewMBarChart()
+	classesWidget.BorderLabel = kClassesLabel
+	classesWidget.BarWidth = 2
+	classesWidget.BarGap = 0
+	classesWidget.BarColor = [termui.NumberofColors]termui.Attribute{
+		termui.ColorGreen, termui.ColorCyan, termui.ColorYellow, termui.ColorRed}
+	classesWidget.NumColor = [termui.NumberofColors]termui.Attribute{
+		termui.ColorBlack, termui.ColorBlack, termui.ColorBlack, termui.ColorBlack}
+	for i := 0; i < 4; i++ {
+		classesWidget.Data[i] = make([]int, 0)
+	}
+	classesWidget.DataLabels = make([]string, 0)
+
 	// The widget holding the line chart of 2-minut moving average hits per second
 	avgWidget := termui.NewLineChart()
 	avgWidget.Mode = "dot"
@@ -94,32 +136,63 @@ func createUI() *widgetCollection {
 	avgWidget.LineColor = termui.ColorGreen | termui.AttrBold
 	avgWidget.DataLabels = make([]string, 0)
 
+	// The widget holding the line chart of recent bytes sent per second
+	bytesWidget := termui.NewLineChart()
+	bytesWidget.Mode = "dot"
+	bytesWidget.BorderLabel = kBytesLabel
+	bytesWidget.LineColor = termui.ColorMagenta | termui.AttrBold
+	bytesWidget.DataLabels = make([]string, 0)
+
+	// The widget holding the line chart of the recent 99th percentile of
+	// the latency, in milliseconds
+	latencyWidget := termui.NewLineChart()
+	latencyWidget.Mode = "dot"
+	latencyWidget.BorderLabel = kLatencyLabel
+	latencyWidget.LineColor = termui.ColorRed | termui.AttrBold
+	latencyWidget.DataLabels = make([]string, 0)
+
 	// The widget holding the one line of user instructions
-	instructionsWidget := termui.NewPar("PRESS <ESC> or q TO QUIT, r TO RESET VISITED SITES COUNTERS")
+	instructionsWidget := termui.NewPar("PRESS <ESC> or q TO QUIT, r TO RESET VISITED SITES COUNTERS, s TO SHOW SITES PER FILE")
 	instructionsWidget.TextFgColor = termui.ColorRed
 	instructionsWidget.BorderFg = termui.ColorCyan
 	instructionsWidget.Height = 3
 
 	widgets := &widgetCollection{
-		sites:  sitesWidget,
-		alerts: alertsWidget,
-		hits:   hitsWidget,
-		avg:    avgWidget,
+		sites:     sitesWidget,
+		routes:    routesWidget,
+		clients:   clientsWidget,
+		agents:    agentsWidget,
+		referrers: referrersWidget,
+		alerts:    alertsWidget,
+		hits:      hitsWidget,
+		avg:       avgWidget,
+		classes:   classesWidget,
+		bytes:     bytesWidget,
+		latency:   latencyWidget,
 	}
 	resizeWidgets(widgets, termui.TermHeight())
 
 	// Build the UI with a grid layout
 	termui.Body.AddRows(
 		termui.NewRow(
-			termui.NewCol(12, 0, hitsWidget),
+			termui.NewCol(8, 0, hitsWidget),
+			termui.NewCol(4, 0, classesWidget),
 		),
 		termui.NewRow(
-			termui.NewCol(12, 0, avgWidget),
+			termui.NewCol(4, 0, avgWidget),
+			termui.NewCol(4, 0, bytesWidget),
+			termui.NewCol(4, 0, latencyWidget),
 		),
 		termui.NewRow(
 			termui.NewCol(6, 0, sitesWidget),
 			termui.NewCol(6, 0, alertsWidget),
 		),
+		termui.NewRow(
+			termui.NewCol(3, 0, routesWidget),
+			termui.NewCol(3, 0, clientsWidget),
+			termui.NewCol(3, 0, referrersWidget),
+			termui.NewCol(3, 0, agentsWidget),
+		),
 		termui.NewRow(
 			termui.NewCol(12, 0, instructionsWidget),
 		),
@@ -140,10 +213,17 @@ func resizeWidgets(widgets *widgetCollection, screenHeight int) {
 	// The instructions use 3 lines at the bottom of the screen
 	usableHeight := float64(screenHeight - 3)
 
-	widgets.sites.Height = int(usableHeight * 0.5)
-	widgets.alerts.Height = int(usableHeight * 0.5)
-	widgets.hits.Height = int(usableHeight * 0.25)
-	widgets.avg.Height = int(usableHeight * 0.25)
+	widgets.sites.Height = int(usableHeight * 0.3)
+	widgets.alerts.Height = int(usableHeight * 0.3)
+	widgets.routes.Height = int(usableHeight * 0.3)
+	widgets.clients.Height = int(usableHeight * 0.3)
+	widgets.agents.Height = int(usableHeight * 0.3)
+	widgets.referrers.Height = int(usableHeight * 0.3)
+	widgets.hits.Height = int(usableHeight * 0.2)
+	widgets.classes.Height = int(usableHeight * 0.2)
+	widgets.avg.Height = int(usableHeight * 0.2)
+	widgets.bytes.Height = int(usableHeight * 0.2)
+	widgets.latency.Height = int(usableHeight * 0.2)
 }
 
 // Connect the UI events to actions to be taken when those events come in.
@@ -163,12 +243,30 @@ func setupEvents(c *collator.Collator, widgets *widgetCollection, collatorError
 	termui.Handle("/sys/kbd/r", func(termui.Event) {
 		c.ResetChan <- true
 		widgets.sites.Items = []string{}
-		termui.Render(widgets.sites)
+		widgets.routes.Items = []string{}
+		widgets.clients.Items = []string{}
+		widgets.agents.Items = []string{}
+		widgets.referrers.Items = []string{}
+		widgets.lastSites = nil
+		termui.Render(widgets.sites, widgets.routes, widgets.clients, widgets.agents, widgets.referrers)
+	})
+
+	// s to switch between the sites of all the logs, and of each log
+	termui.Handle("/sys/kbd/s", func(termui.Event) {
+		widgets.sitesBySource = !widgets.sitesBySource
+		if widgets.lastSites != nil {
+			updateSitesWidget(widgets.sites, widgets.lastSites, widgets.sitesBySource)
+		}
 	})
 
 	// Sites data
 	termui.Handle("/custom/sites", func(e termui.Event) {
-		updateSitesWidget(widgets.sites, e.Data.(*collator.Sites))
+		widgets.lastSites = e.Data.(*collator.Sites)
+		updateSitesWidget(widgets.sites, widgets.lastSites, widgets.sitesBySource)
+		updateCountsWidget(widgets.routes, widgets.lastSites.Routes)
+		updateCountsWidget(widgets.clients, widgets.lastSites.Clients)
+		updateAgentsWidget(widgets.agents, widgets.lastSites)
+		updateCountsWidget(widgets.referrers, widgets.lastSites.Referrers)
 	})
 
 	// Alert data
@@ -179,7 +277,11 @@ func setupEvents(c *collator.Collator, widgets *widgetCollection, collatorError
 	// Status data
 	termui.Handle("/custom/status", func(e termui.Event) {
 		updateHitsWidget(widgets.hits, e.Data.(*collator.Status))
+		updateClassesWidget(widgets.classes, e.Data.(*collator.Status))
 		updateAvgWidget(widgets.avg, e.Data.(*collator.Status))
+		updateBytesWidget(widgets.bytes, e.Data.(*collator.Status))
+		updateAgentsLabel(widgets.agents, e.Data.(*collator.Status))
+		updateLatencyWidget(widgets.latency, e.Data.(*collator.Status))
 	})
 
 	// Error from Collator
@@ -200,31 +302,115 @@ func setupEvents(c *collator.Collator, widgets *widgetCollection, collatorError
 	})
 }
 
-// Update the list of sites and their number of hits
-func updateSitesWidget(stats *termui.List, sites *collator.Sites) {
-	//	stats.Text = ""
-	stats.Items = make([]string, len(sites.Sites))
+// Update the list of sites and their number of hits, either for all the
+// logs together, or for each log file under its name.
+func updateSitesWidget(stats *termui.List, sites *collator.Sites, bySource bool) {
+	if !bySource {
+		stats.BorderLabel = "Highest Visited Sites"
+		stats.Items = siteItems(sites.Sites)
+		termui.Render(stats)
+		return
+	}
+
+	stats.BorderLabel = "Highest Visited Sites Per File"
+	sources := make([]string, 0, len(sites.BySource))
+	for source := range sites.BySource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	stats.Items = []string{}
+	for _, source := range sources {
+		stats.Items = append(stats.Items, fmt.Sprintf("[%s](fg-cyan)", filepath.Base(source)))
+		stats.Items = append(stats.Items, siteItems(sites.BySource[source])...)
+	}
+	termui.Render(stats)
+}
+
+// Format the sites as list items.
+func siteItems(sites []collator.Site) []string {
+	items := make([]string, len(sites))
 
 	// Find the larget number of digits used to represent a number,
 	// so we can build a format string and have the numbers aligned nicely.
 	largestWidth := 0
-	for _, site := range sites.Sites {
+	for _, site := range sites {
 		thisWidth := len(strconv.Itoa(site.TotalHits))
 		if thisWidth > largestWidth {
 			largestWidth = thisWidth
 		}
 	}
+	formatString := fmt.Sprintf("%%%dd: %%s %%s", largestWidth)
+
+	// Fill in the list of sites, with their bytes and server errors
+	for i, site := range sites {
+		items[i] = fmt.Sprintf(formatString, site.TotalHits, site.Site,
+			"[("+formatBytes(float64(site.Bytes))+")](fg-magenta)")
+		if site.Latency.Hits > 0 {
+			items[i] += fmt.Sprintf(" [(p99 %s)](fg-yellow)", formatLatency(site.Latency.P99))
+		}
+		if site.Errors > 0 {
+			items[i] += fmt.Sprintf(" [(%d 5xx, %.1f%%)](fg-red)", site.Errors, site.ErrorRate*100)
+		}
+		items[i] += "\n"
+	}
+	return items
+}
+
+// Update a list of names and their number of hits, such as the routes.
+func updateCountsWidget(list *termui.List, counts []collator.Count) {
+	items := make([]string, len(counts))
+	largestWidth := 0
+	for _, count := range counts {
+		thisWidth := len(strconv.Itoa(count.Hits))
+		if thisWidth > largestWidth {
+			largestWidth = thisWidth
+		}
+	}
 	formatString := fmt.Sprintf("%%%dd: %%s\n", largestWidth)
+	for i, count := range counts {
+		items[i] = fmt.Sprintf(formatString, count.Hits, count.Name)
+	}
+	list.Items = items
+	termui.Render(list)
+}
 
-	// Fill in the list of sites
-	for i, site := range sites.Sites {
-		stats.Items[i] = fmt.Sprintf(formatString, site.TotalHits, site.Site)
+// Update the lists of top browsers, operating systems, and crawlers
+func updateAgentsWidget(agentsWidget *termui.List, sites *collator.Sites) {
+	agentsWidget.Items = []string{}
+	for _, agents := range []struct {
+		title  string
+		counts []collator.Count
+	}{
+		{"Browsers", sites.Browsers},
+		{"Operating Systems", sites.OperatingSystems},
+		{"Crawlers", sites.Crawlers},
+	} {
+		if len(agents.counts) == 0 {
+			continue
+		}
+		agentsWidget.Items = append(agentsWidget.Items, fmt.Sprintf("[%s](fg-cyan)", agents.title))
+		for _, count := range agents.counts {
+			agentsWidget.Items = append(agentsWidget.Items, fmt.Sprintf("%d: %s\n", count.Hits, count.Name))
+		}
 	}
+	termui.Render(agentsWidget)
+}
 
-	termui.Render(stats)
+// Show the hits of the last second by their kind of user agent
+func updateAgentsLabel(agentsWidget *termui.List, status *collator.Status) {
+	agentsWidget.BorderLabel = fmt.Sprintf("%s (%d human, %d crawler, %d other)", kAgentsLabel,
+		status.HumanHits, status.CrawlerHits, status.OtherAgentHits)
+	termui.Render(agentsWidget)
 }
 
 const (
+	kHitsLabel    = "Hits Per Second"
+	kClassesLabel = "2xx/3xx/4xx/5xx Per Second"
+	kBytesLabel   = "Bytes Per Second"
+	kAgentsLabel  = "User Agents"
+	kLatencyLabel = "p99 Latency (ms)"
+
 	// The Golang way of saying Year-Month-Day Hour:Minute:Second.FractionalSecond
 	kTimeFormat = "2006-01-02 15:04:05.000"
 )
@@ -233,13 +419,26 @@ const (
 // XXX - does this scroll? it seems it does not, and thus extra logic would
 // be required to autoscroll and scroll this widget.
 func updateAlertsWidget(alertsWidget *termui.List, alert *collator.Alert) {
+	var source string
+	if alert.Source != "" {
+		source = " in " + filepath.Base(alert.Source)
+	}
+
 	var newText string
-	if alert.InAlertState {
-		newText = fmt.Sprintf("%s [ALERT](fg-white,bg-red) High traffic; hits = %.1f/s\n",
-			alert.Time.Format(kTimeFormat), alert.AverageHitsPerSecond)
+	if alert.Rule != "" && alert.Rule != "hits" {
+		if alert.InAlertState {
+			newText = fmt.Sprintf("%s [ALERT](fg-white,bg-red) %s%s: %s\n",
+				alert.Time.Format(kTimeFormat), alert.Rule, source, alert.Reason)
+		} else {
+			newText = fmt.Sprintf("%s       Recovered from %s%s: %s\n",
+				alert.Time.Format(kTimeFormat), alert.Rule, source, alert.Reason)
+		}
+	} else if alert.InAlertState {
+		newText = fmt.Sprintf("%s [ALERT](fg-white,bg-red) High traffic%s; hits = %.1f/s\n",
+			alert.Time.Format(kTimeFormat), source, alert.AverageHitsPerSecond)
 	} else {
-		newText = fmt.Sprintf("%s       Recovered, hits = %.1f/s\n",
-			alert.Time.Format(kTimeFormat), alert.AverageHitsPerSecond)
+		newText = fmt.Sprintf("%s       Recovered%s, hits = %.1f/s\n",
+			alert.Time.Format(kTimeFormat), source, alert.AverageHitsPerSecond)
 	}
 
 	alertsWidget.Items = append(alertsWidget.Items, newText)
@@ -249,6 +448,7 @@ func updateAlertsWidget(alertsWidget *termui.List, alert *collator.Alert) {
 
 // Update the latest hits per second line chart
 func updateHitsWidget(hitsWidget *termui.LineChart, status *collator.Status) {
+	hitsWidget.BorderLabel = hitsLabel(status)
 	hitsWidget.Data = append(hitsWidget.Data, float64(status.HitsLastSecond))
 	// If there are too many, remove some from the front
 	if len(hitsWidget.Data) > hitsWidget.Width {
@@ -261,6 +461,59 @@ func updateHitsWidget(hitsWidget *termui.LineChart, status *collator.Status) {
 	termui.Render(hitsWidget)
 }
 
+// The label for the hits per second line chart, which also notes any lines
+// that could not be parsed, and any entries that came too late to be counted.
+func hitsLabel(status *collator.Status) string {
+	var notes []string
+	if status.BadLines > 0 {
+		last := status.RecentBadLines[len(status.RecentBadLines)-1]
+		notes = append(notes, fmt.Sprintf("%d bad lines; last at %s line %d, column %d",
+			status.BadLines, filepath.Base(last.Source), last.LineNumber, last.Column))
+	}
+	if status.LateEntries > 0 {
+		notes = append(notes, fmt.Sprintf("%d late entries", status.LateEntries))
+	}
+	if len(notes) == 0 {
+		return kHitsLabel
+	}
+	return fmt.Sprintf("%s (%s)", kHitsLabel, strings.Join(notes, "; "))
+}
+
+// Update the stacked bar chart of hits per second by status class
+func updateClassesWidget(classesWidget *termui.MBarChart, status *collator.Status) {
+	classes := []int{status.Hits2xx, status.Hits3xx, status.Hits4xx, status.Hits5xx}
+	for i, hits := range classes {
+		classesWidget.Data[i] = append(classesWidget.Data[i], hits)
+	}
+	classesWidget.DataLabels = append(classesWidget.DataLabels, "")
+
+	// Only keep as many bars as fit
+	maxBars := (classesWidget.Width - 2) / (classesWidget.BarWidth + classesWidget.BarGap)
+	for len(classesWidget.DataLabels) > maxBars && len(classesWidget.DataLabels) > 0 {
+		for i := range classes {
+			classesWidget.Data[i] = classesWidget.Data[i][1:]
+		}
+		classesWidget.DataLabels = classesWidget.DataLabels[1:]
+	}
+
+	// The chart never lowers its scale by itself
+	max := 1
+	for j := range classesWidget.DataLabels {
+		sum := 0
+		for i := range classes {
+			sum += classesWidget.Data[i][j]
+		}
+		if sum > max {
+			max = sum
+		}
+	}
+	classesWidget.SetMax(max)
+
+	classesWidget.BorderLabel = fmt.Sprintf("%s (%d/%d/%d/%d)", kClassesLabel,
+		status.Hits2xx, status.Hits3xx, status.Hits4xx, status.Hits5xx)
+	termui.Render(classesWidget)
+}
+
 // Update the moving average hits per second line chart
 func updateAvgWidget(avgWidget *termui.LineChart, status *collator.Status) {
 	avgWidget.Data = append(avgWidget.Data, float64(status.AverageHitsPerSecond))
@@ -274,3 +527,58 @@ func updateAvgWidget(avgWidget *termui.LineChart, status *collator.Status) {
 	}
 	termui.Render(avgWidget)
 }
+
+// Update the bytes per second line chart
+func updateBytesWidget(bytesWidget *termui.LineChart, status *collator.Status) {
+	bytesWidget.BorderLabel = fmt.Sprintf("%s (2-minute average %s/s)", kBytesLabel,
+		formatBytes(status.AverageBytesPerSecond))
+	bytesWidget.Data = append(bytesWidget.Data, float64(status.BytesLastSecond))
+	// If there are too many, remove some from the front
+	if len(bytesWidget.Data) > bytesWidget.Width {
+		bytesWidget.Data = bytesWidget.Data[1:]
+	} else {
+		bytesWidget.DataLabels = append(bytesWidget.DataLabels, "")
+	}
+	termui.Render(bytesWidget)
+}
+
+// Format a number of bytes with a unit, e.g. 1.5 MB
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+// Update the latency line chart, which charts the 99th percentile, and notes
+// the other percentiles. The seconds without durations are charted as 0.
+func updateLatencyWidget(latencyWidget *termui.LineChart, status *collator.Status) {
+	latency := status.Latency
+	if latency.Hits > 0 {
+		latencyWidget.BorderLabel = fmt.Sprintf("%s (p50 %s, p90 %s, p99 %s, max %s)", kLatencyLabel,
+			formatLatency(latency.P50), formatLatency(latency.P90), formatLatency(latency.P99),
+			formatLatency(latency.Max))
+	}
+	latencyWidget.Data = append(latencyWidget.Data, latency.P99.Seconds()*1000)
+	// If there are too many, remove some from the front
+	if len(latencyWidget.Data) > latencyWidget.Width {
+		latencyWidget.Data = latencyWidget.Data[1:]
+	} else {
+		latencyWidget.DataLabels = append(latencyWidget.DataLabels, "")
+	}
+	termui.Render(latencyWidget)
+}
+
+// Format a latency in milliseconds, or in seconds if it is that long
+func formatLatency(latency time.Duration) string {
+	if latency >= time.Second {
+		return fmt.Sprintf("%.2fs", latency.Seconds())
+	}
+	return fmt.Sprintf("%.1fms", latency.Seconds()*1000)
+}
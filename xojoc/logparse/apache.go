@@ -0,0 +1,261 @@
+/* Copyright (C) 2015 by Alexandru Cojocaru */
+
+/* This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package logparse
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"xojoc.pw/useragent"
+)
+
+// CompileApache compiles an Apache LogFormat string, as described in
+// https://httpd.apache.org/docs/current/mod/mod_log_config.html, into a
+// Parser for logs written with that format. For example, the combined log
+// format is:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"
+//
+// The directives mapped onto Entry are:
+//
+//	%h %a %u %t %{sec}t %{msec}t %{usec}t %r %m %U %q %H %s %b %B
+//	%D %T %{UNIT}T %{Referer}i %{User-Agent}i
+//
+// The values of any other directives are kept in Entry.Extra, keyed by the
+// directive as it is written in the format, e.g. "%v" or "%{Host}i". This
+// is also where %h is kept if it is a host name instead of an IP address.
+func CompileApache(logFormat string) (Parser, error) {
+	t := &template{}
+	s := logFormat
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '%')
+		if i < 0 {
+			t.addLiteral(s)
+			break
+		}
+		t.addLiteral(s[:i])
+		s = s[i:]
+
+		if strings.HasPrefix(s, "%%") {
+			t.addLiteral("%")
+			s = s[2:]
+			continue
+		}
+
+		f, n, err := apacheDirective(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.addField(f); err != nil {
+			return nil, err
+		}
+		s = s[n:]
+	}
+	if err := t.finish(); err != nil {
+		return nil, err
+	}
+	return t.parse, nil
+}
+
+// Parse the directive at the start of s, returning its field and its length.
+func apacheDirective(s string) (*templateField, int, error) {
+	// Skip the '%'
+	n := 1
+
+	// Skip any conditions on the status code, e.g. %!200,304{Referer}i,
+	// and the choice of the original or final request, e.g. %>s
+	for n < len(s) && strings.IndexByte("!0123456789,<>", s[n]) >= 0 {
+		n++
+	}
+
+	var arg string
+	if n < len(s) && s[n] == '{' {
+		end := strings.IndexByte(s[n:], '}')
+		if end < 0 {
+			return nil, 0, fmt.Errorf("unterminated directive %q", s)
+		}
+		arg = s[n+1 : n+end]
+		n += end + 1
+	}
+	if n >= len(s) {
+		return nil, 0, fmt.Errorf("incomplete directive %q", s)
+	}
+	letter := s[n]
+	n++
+
+	f := &templateField{name: s[:n], set: setExtra}
+
+	switch letter {
+	case 'h', 'a':
+		f.set = setHost
+	case 'u':
+		f.set = setUser
+	case 't':
+		switch arg {
+		case "":
+			f.open, f.close = "[", "]"
+			f.set = setTime
+		case "sec":
+			f.set = setEpochTime(time.Second)
+		case "msec":
+			f.set = setEpochTime(time.Millisecond)
+		case "usec":
+			f.set = setEpochTime(time.Microsecond)
+		}
+	case 'r':
+		f.set = setRequestLine
+	case 'm':
+		f.set = setMethod
+	case 'U':
+		f.set = setPath
+	case 'q':
+		f.set = setQuery
+		f.prefix = "?"
+	case 'H':
+		f.set = setProto
+	case 's':
+		f.set = setStatus
+	case 'b', 'B':
+		f.set = setBytes
+	case 'D':
+		f.set = setDuration(time.Microsecond)
+	case 'T':
+		switch arg {
+		case "", "s":
+			f.set = setDuration(time.Second)
+		case "ms":
+			f.set = setDuration(time.Millisecond)
+		case "us":
+			f.set = setDuration(time.Microsecond)
+		}
+	case 'i':
+		switch strings.ToLower(arg) {
+		case "referer":
+			f.set = setReferer
+		case "user-agent":
+			f.set = setUserAgent
+			f.userAgent = true
+		}
+	}
+	return f, n, nil
+}
+
+// These set the value of a field in the Entry being built. They are shared
+// by all the custom formats.
+
+func setExtra(b *entryBuilder, name, value string) error {
+	b.setExtra(name, value)
+	return nil
+}
+
+func setHost(b *entryBuilder, name, value string) error {
+	b.e.Host = net.ParseIP(value)
+	if b.e.Host == nil {
+		// A host name, if the server looks them up
+		b.setExtra(name, value)
+	}
+	return nil
+}
+
+func setUser(b *entryBuilder, name, value string) error {
+	b.e.User = value
+	return nil
+}
+
+func setTime(b *entryBuilder, name, value string) error {
+	var err error
+	b.e.Time, err = time.Parse(timeLayout, value)
+	return err
+}
+
+func setEpochTime(unit time.Duration) func(*entryBuilder, string, string) error {
+	return func(b *entryBuilder, name, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		nsec := int64(f * float64(unit))
+		b.e.Time = time.Unix(0, nsec)
+		return nil
+	}
+}
+
+func setRequestLine(b *entryBuilder, name, value string) error {
+	b.requestLine = value
+	return nil
+}
+
+func setMethod(b *entryBuilder, name, value string) error {
+	b.method = value
+	return nil
+}
+
+func setURI(b *entryBuilder, name, value string) error {
+	b.uri = value
+	return nil
+}
+
+func setPath(b *entryBuilder, name, value string) error {
+	b.path = value
+	return nil
+}
+
+func setQuery(b *entryBuilder, name, value string) error {
+	b.query = value
+	return nil
+}
+
+func setProto(b *entryBuilder, name, value string) error {
+	b.proto = value
+	return nil
+}
+
+func setStatus(b *entryBuilder, name, value string) error {
+	var err error
+	b.e.Status, err = strconv.Atoi(value)
+	return err
+}
+
+func setBytes(b *entryBuilder, name, value string) error {
+	var err error
+	b.e.Bytes, err = strconv.Atoi(value)
+	return err
+}
+
+func setDuration(unit time.Duration) func(*entryBuilder, string, string) error {
+	return func(b *entryBuilder, name, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		b.e.Duration = time.Duration(f * float64(unit))
+		return nil
+	}
+}
+
+func setReferer(b *entryBuilder, name, value string) error {
+	var err error
+	b.e.Referer, err = url.ParseRequestURI(value)
+	return err
+}
+
+func setUserAgent(b *entryBuilder, name, value string) error {
+	b.e.UserAgent = useragent.Parse(value)
+	return nil
+}
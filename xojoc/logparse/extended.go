@@ -0,0 +1,256 @@
+/* Copyright (C) 2015 by Alexandru Cojocaru */
+
+/* This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package logparse
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"xojoc.pw/useragent"
+)
+
+const (
+	extendedDateLayout     = "2006-01-02"
+	extendedTimeLayout     = "15:04:05"
+	extendedDateTimeLayout = extendedDateLayout + " " + extendedTimeLayout
+)
+
+// An ExtendedDirective holds the directives read so far from a log in the
+// W3C extended log format. The zero value is ready to use, and a separate
+// ExtendedDirective must be used for each log.
+type ExtendedDirective struct {
+	// The version of the extended log format, from #Version.
+	Version string
+	// The names of the fields in each entry, from #Fields.
+	Fields []string
+	// The software which generated the log, from #Software.
+	Software string
+	// The date and time at which the entries were added, from #Date.
+	Date time.Time
+}
+
+// Extended parses a log line in the W3C extended log format, as described
+// in https://www.w3.org/TR/WD-logfile.html.
+//
+// Directive lines (those starting with '#') are remembered in x and return
+// a nil Entry and no error. An entry line can only be parsed after a
+// #Fields directive. The fields mapped onto Entry are:
+//
+//	date time c-ip cs-username cs-method cs-uri-stem cs-uri-query cs-uri
+//	cs-version sc-status sc-bytes time-taken cs(User-Agent) cs(Referer)
+//
+// Other fields are ignored. Following the specification, time-taken is in
+// seconds, except in logs written by IIS, where it is in milliseconds.
+func (x *ExtendedDirective) Extended(line string) (*Entry, error) {
+	l := newLex(line)
+	var e *Entry
+	var err error
+	if strings.HasPrefix(line, "#") {
+		err = x.directive(l)
+	} else {
+		e, err = x.entry(l)
+	}
+	if err != nil {
+		return nil, newSyntaxError(l, err)
+	}
+	return e, nil
+}
+
+func (x *ExtendedDirective) directive(l *lex) error {
+	l.match("#")
+	name, err := nextField(l, ":")
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(l.s[l.p:])
+	l.p = len(l.s)
+
+	switch name {
+	case "Version":
+		x.Version = value
+	case "Fields":
+		x.Fields = strings.Fields(value)
+	case "Software":
+		x.Software = value
+	case "Date":
+		x.Date, err = time.Parse(extendedDateTimeLayout, value)
+		if err != nil {
+			return err
+		}
+	}
+	// Other directives (#Start-Date, #End-Date, #Remark) are not needed
+	return nil
+}
+
+// IIS logs time-taken in milliseconds instead of seconds.
+func (x *ExtendedDirective) isIIS() bool {
+	return strings.HasPrefix(x.Software, "Microsoft Internet Information Services")
+}
+
+func (x *ExtendedDirective) entry(l *lex) (*Entry, error) {
+	if x.Fields == nil {
+		return nil, fmt.Errorf("no #Fields directive before the first entry")
+	}
+
+	e := &Entry{Status: -1, Duration: -1}
+	var date, clock, method, stem, query, uri, proto string
+
+	for i, field := range x.Fields {
+		value, quoted, err := extendedValue(l, i == len(x.Fields)-1)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", field, err)
+		}
+		if field == "cs(User-Agent)" {
+			e.HasUserAgent = true
+		}
+		if value == "-" && !quoted {
+			continue
+		}
+
+		switch field {
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		case "c-ip":
+			e.Host = net.ParseIP(value)
+			if e.Host == nil {
+				return nil, fmt.Errorf("cannot parse IP %q", value)
+			}
+		case "cs-username":
+			e.User = value
+		case "cs-method":
+			method = value
+		case "cs-uri-stem":
+			stem = value
+		case "cs-uri-query":
+			query = value
+		case "cs-uri":
+			uri = value
+		case "cs-version":
+			proto = value
+		case "sc-status":
+			e.Status, err = strconv.Atoi(value)
+		case "sc-bytes":
+			e.Bytes, err = strconv.Atoi(value)
+		case "time-taken":
+			e.Duration, err = x.timeTaken(value)
+		case "cs(User-Agent)":
+			if !quoted {
+				// IIS replaces the spaces in the user agent with '+'
+				value = strings.Replace(value, "+", " ", -1)
+			}
+			e.UserAgent = useragent.Parse(value)
+		case "cs(Referer)":
+			e.Referer, err = url.ParseRequestURI(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", field, err)
+		}
+	}
+
+	var err error
+	e.Time, err = x.entryTime(date, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri == "" && stem != "" {
+		uri = stem
+		if query != "" {
+			uri += "?" + query
+		}
+	}
+	if uri != "" {
+		e.Request, err = newRequest(method, uri, proto)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Read the next value of an entry. Values are separated by whitespace, and
+// may be quoted, with a double quote inside a quoted value written as "".
+func extendedValue(l *lex, last bool) (value string, quoted bool, err error) {
+	if l.match(`"`) {
+		for {
+			part, ok := l.span(`"`)
+			if !ok {
+				return "", true, fmt.Errorf("unterminated quoted value")
+			}
+			value += part
+			if !l.match(`"`) {
+				break
+			}
+			value += `"`
+		}
+		quoted = true
+	} else {
+		end := strings.IndexAny(l.s[l.p:], " \t")
+		if end < 0 {
+			end = len(l.s) - l.p
+		}
+		value = l.s[l.p : l.p+end]
+		l.p += end
+	}
+
+	// Skip the separator, checking the number of values
+	rest := l.s[l.p:]
+	trimmed := strings.TrimLeft(rest, " \t")
+	if last {
+		if trimmed != "" {
+			return "", quoted, fmt.Errorf("more values than fields")
+		}
+	} else if trimmed == "" {
+		return "", quoted, fmt.Errorf("fewer values than fields")
+	} else if len(trimmed) == len(rest) {
+		return "", quoted, fmt.Errorf("expected a separator after %q", value)
+	}
+	l.p += len(rest) - len(trimmed)
+	return value, quoted, nil
+}
+
+// The time of an entry; times are in UTC, and if the entry has no date,
+// the date comes from the #Date directive.
+func (x *ExtendedDirective) entryTime(date, clock string) (time.Time, error) {
+	if clock == "" {
+		return time.Time{}, nil
+	}
+	if date == "" {
+		if x.Date.IsZero() {
+			return time.Time{}, nil
+		}
+		date = x.Date.Format(extendedDateLayout)
+	}
+	// time.Parse also accepts a fractional part of the seconds
+	return time.Parse(extendedDateTimeLayout, date+" "+clock)
+}
+
+func (x *ExtendedDirective) timeTaken(value string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return -1, err
+	}
+	if x.isIIS() {
+		return time.Duration(f * float64(time.Millisecond)), nil
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
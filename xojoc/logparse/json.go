@@ -0,0 +1,333 @@
+/* Copyright (C) 2015 by Alexandru Cojocaru */
+
+/* This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package logparse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"xojoc.pw/useragent"
+)
+
+// A JSONMapping gives the keys which hold the fields of an Entry, in a log
+// with one JSON object per line. A key can be a dotted path into nested
+// objects, like "request.remote_ip". An empty key means that the log does
+// not have that field.
+type JSONMapping struct {
+	Host      string
+	User      string
+	Time      string
+	Method    string
+	URI       string
+	Proto     string
+	Status    string
+	Bytes     string
+	Referer   string
+	UserAgent string
+	Duration  string
+
+	// How times are written: either a layout for time.Parse, or "s", "ms",
+	// "us" or "ns" for a number of those units since the Unix epoch.
+	// RFC 3339 if empty.
+	TimeLayout string
+	// The unit of durations which are written as numbers: "s", "ms", "us"
+	// or "ns". Seconds if empty. Durations can also be written as strings
+	// like "1.5ms".
+	DurationUnit string
+}
+
+// DefaultJSONMapping is the mapping for the access logs written by Caddy.
+var DefaultJSONMapping = JSONMapping{
+	Host:       "request.remote_ip",
+	User:       "user_id",
+	Time:       "ts",
+	Method:     "request.method",
+	URI:        "request.uri",
+	Proto:      "request.proto",
+	Status:     "status",
+	Bytes:      "size",
+	Referer:    "request.headers.Referer",
+	UserAgent:  "request.headers.User-Agent",
+	Duration:   "duration",
+	TimeLayout: "s",
+}
+
+// ParseJSONMapping parses a JSONMapping written as comma-separated
+// name=key pairs, where the names are host, user, time, method, uri,
+// proto, status, bytes, referer, user_agent, duration, time_layout and
+// duration_unit. The fields which are not given keep their values from
+// DefaultJSONMapping. For example:
+//
+//	time=time,time_layout=2006-01-02T15:04:05Z07:00,host=client.ip
+func ParseJSONMapping(spec string) (*JSONMapping, error) {
+	m := DefaultJSONMapping
+	fields := map[string]*string{
+		"host":          &m.Host,
+		"user":          &m.User,
+		"time":          &m.Time,
+		"method":        &m.Method,
+		"uri":           &m.URI,
+		"proto":         &m.Proto,
+		"status":        &m.Status,
+		"bytes":         &m.Bytes,
+		"referer":       &m.Referer,
+		"user_agent":    &m.UserAgent,
+		"duration":      &m.Duration,
+		"time_layout":   &m.TimeLayout,
+		"duration_unit": &m.DurationUnit,
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("expected name=key but got %q", pair)
+		}
+		field, ok := fields[pair[:i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", pair[:i])
+		}
+		*field = pair[i+1:]
+	}
+
+	if _, err := epochUnit(m.DurationUnit); m.DurationUnit != "" && err != nil {
+		return nil, fmt.Errorf("duration_unit: %s", err)
+	}
+	return &m, nil
+}
+
+// NewJSON returns a Parser for logs with one JSON object per line, using m
+// to find the fields of the Entry. The values of all the other keys are
+// kept in Entry.Extra, keyed by their dotted paths.
+func NewJSON(m *JSONMapping) Parser {
+	return func(line string) (*Entry, error) {
+		e, err := m.entry(line)
+		if err != nil {
+			return nil, &SyntaxError{Column: 1, Err: err}
+		}
+		return e, nil
+	}
+}
+
+func (m *JSONMapping) entry(line string) (*Entry, error) {
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+
+	e := &Entry{Status: -1, Duration: -1}
+	var err error
+	var method, uri, proto string
+
+	if v, ok := m.value(obj, m.Host); ok {
+		e.Host = net.ParseIP(v)
+		if e.Host == nil {
+			// It may be an address with a port
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				e.Host = net.ParseIP(host)
+			}
+		}
+		if e.Host == nil {
+			return nil, fmt.Errorf("cannot parse IP %q", v)
+		}
+	}
+	if v, ok := m.value(obj, m.User); ok {
+		e.User = v
+	}
+	if v, ok := m.value(obj, m.Time); ok {
+		if e.Time, err = m.parseTime(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Time, err)
+		}
+	}
+	if v, ok := m.value(obj, m.Method); ok {
+		method = v
+	}
+	if v, ok := m.value(obj, m.URI); ok {
+		uri = v
+	}
+	if v, ok := m.value(obj, m.Proto); ok {
+		proto = v
+	}
+	if v, ok := m.value(obj, m.Status); ok {
+		if e.Status, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Status, err)
+		}
+	}
+	if v, ok := m.value(obj, m.Bytes); ok {
+		if e.Bytes, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Bytes, err)
+		}
+	}
+	if v, ok := m.value(obj, m.Referer); ok {
+		if e.Referer, err = url.ParseRequestURI(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Referer, err)
+		}
+	}
+	if m.UserAgent != "" {
+		_, e.HasUserAgent = lookupJSON(obj, m.UserAgent)
+	}
+	if v, ok := m.value(obj, m.UserAgent); ok {
+		e.UserAgent = useragent.Parse(v)
+	}
+	if v, ok := m.value(obj, m.Duration); ok {
+		if e.Duration, err = m.parseDuration(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Duration, err)
+		}
+	}
+
+	if uri != "" {
+		if e.Request, err = newRequest(method, uri, proto); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep everything that was not mapped
+	m.addExtra(e, "", obj)
+
+	return e, nil
+}
+
+// Find the value at the dotted path in obj. A key in an object can itself
+// contain dots, so at each level the longest matching key is used.
+func lookupJSON(obj map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := obj[path]; ok {
+		return v, true
+	}
+	for i := strings.LastIndexByte(path, '.'); i > 0; i = strings.LastIndexByte(path[:i], '.') {
+		if sub, ok := obj[path[:i]].(map[string]interface{}); ok {
+			if v, ok := lookupJSON(sub, path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// The value at the key, as a string. Missing and null values, and empty
+// strings, are not found.
+func (m *JSONMapping) value(obj map[string]interface{}, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	v, ok := lookupJSON(obj, key)
+	if !ok {
+		return "", false
+	}
+	// Headers are often lists of values; use the first
+	if list, ok := v.([]interface{}); ok {
+		if len(list) == 0 {
+			return "", false
+		}
+		v = list[0]
+	}
+	s := jsonString(v)
+	return s, s != ""
+}
+
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+func (m *JSONMapping) isMapped(key string) bool {
+	switch key {
+	case m.Host, m.User, m.Time, m.Method, m.URI, m.Proto, m.Status,
+		m.Bytes, m.Referer, m.UserAgent, m.Duration:
+		return true
+	}
+	return false
+}
+
+// Add the values in obj which are not mapped to the Entry to e.Extra.
+func (m *JSONMapping) addExtra(e *Entry, prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		key := prefix + k
+		if m.isMapped(key) {
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			m.addExtra(e, key+".", sub)
+			continue
+		}
+		if e.Extra == nil {
+			e.Extra = make(map[string]string)
+		}
+		e.Extra[key] = jsonString(v)
+	}
+}
+
+// The duration of each of the units which can be used for epoch times
+// and durations.
+func epochUnit(unit string) (time.Duration, error) {
+	switch unit {
+	case "", "s":
+		return time.Second, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ns":
+		return time.Nanosecond, nil
+	}
+	return 0, fmt.Errorf("unknown unit %q", unit)
+}
+
+func (m *JSONMapping) parseTime(v string) (time.Time, error) {
+	switch m.TimeLayout {
+	case "":
+		return time.Parse(time.RFC3339, v)
+	case "s", "ms", "us", "ns":
+		unit, _ := epochUnit(m.TimeLayout)
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(unit))), nil
+	}
+	return time.Parse(m.TimeLayout, v)
+}
+
+func (m *JSONMapping) parseDuration(v string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.ParseDuration(v)
+	}
+	unit, err := epochUnit(m.DurationUnit)
+	if err != nil {
+		return -1, err
+	}
+	return time.Duration(f * float64(unit)), nil
+}
@@ -42,6 +42,14 @@ func (l *lex) next() (r rune) {
 	return
 }
 
+func (l *lex) peek() rune {
+	if l.p >= len(l.s) {
+		return eof
+	}
+	r, _ := utf8.DecodeRuneInString(l.s[l.p:])
+	return r
+}
+
 func (l *lex) LineNumber() int {
 	return 1 + strings.Count(l.s[:l.p], "\n")
 }
@@ -49,6 +49,14 @@ type Entry struct {
 	Referer *url.URL
 	// The user agent of the client (nil if unknown).
 	UserAgent *useragent.UserAgent
+	// The format logs the user agent of the client, even if it is unknown
+	// in this entry, as a "-" or an agent which Parse does not recognize.
+	HasUserAgent bool
+	// The time taken to serve the request (-1 if unknown).
+	Duration time.Duration
+	// Other fields from the log which have no place in Entry, keyed by
+	// the name the format uses for them (nil if none).
+	Extra map[string]string
 }
 
 // Formats the Entry e in the combined log format.
@@ -111,6 +119,22 @@ func (e *Entry) String() string {
 	return s
 }
 
+// A SyntaxError is returned when a log line cannot be parsed.
+type SyntaxError struct {
+	// The column at which the parsing stopped.
+	Column int
+	// The reason the line could not be parsed.
+	Err error
+}
+
+func newSyntaxError(l *lex, err error) *SyntaxError {
+	return &SyntaxError{Column: l.ColumnNumber(), Err: err}
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Err)
+}
+
 func nextField(l *lex, sep string) (string, error) {
 	f, ok := l.span(sep)
 	if !ok {
@@ -121,19 +145,48 @@ func nextField(l *lex, sep string) (string, error) {
 
 func expect(l *lex, sep rune) error {
 	if !l.match(string(sep)) {
-		r := l.next()
+		r := l.peek()
 		if r == eof {
 			return fmt.Errorf("expected %q but got EOF", sep)
 		} else {
-			return fmt.Errorf("%d: expected %q but got %q", l.ColumnNumber()-1, sep, r)
+			return fmt.Errorf("expected %q but got %q", sep, r)
 		}
 	}
 	return nil
 }
 
+// Parse an HTTP request line, e.g. "GET /index.html HTTP/1.0"
+func parseRequestLine(r string) (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(strings.NewReader(r + "\r\n\r\n")))
+}
+
+// Create an HTTP request for formats that log the parts of the request
+// line separately. The method and proto may be empty.
+func newRequest(method, uri, proto string) (*http.Request, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      proto,
+		Header:     make(http.Header),
+		RequestURI: uri,
+	}
+	if proto != "" {
+		var ok bool
+		req.ProtoMajor, req.ProtoMinor, ok = http.ParseHTTPVersion(proto)
+		if !ok {
+			return nil, fmt.Errorf("malformed HTTP version %q", proto)
+		}
+	}
+	return req, nil
+}
+
 // FIXME: error checks are too noisy
 func common(l *lex) (*Entry, error) {
-	e := &Entry{}
+	e := &Entry{Duration: -1}
 
 	ip, err := nextField(l, " ")
 	if err != nil {
@@ -175,7 +228,7 @@ func common(l *lex) (*Entry, error) {
 	if err != nil {
 		return nil, err
 	}
-	e.Request, err = http.ReadRequest(bufio.NewReader(strings.NewReader(r + "\r\n\r\n")))
+	e.Request, err = parseRequestLine(r)
 	if err != nil {
 		return nil, err
 	}
@@ -217,7 +270,10 @@ func common(l *lex) (*Entry, error) {
 func Common(line string) (*Entry, error) {
 	l := newLex(line)
 	e, err := common(l)
-	return e, err
+	if err != nil {
+		return nil, newSyntaxError(l, err)
+	}
+	return e, nil
 }
 
 // Combined parses a log line containing a log entry in the combined log format.
@@ -229,6 +285,14 @@ func Common(line string) (*Entry, error) {
 //  UserAgent the user agent of the client
 func Combined(line string) (*Entry, error) {
 	l := newLex(line)
+	e, err := combined(l)
+	if err != nil {
+		return nil, newSyntaxError(l, err)
+	}
+	return e, nil
+}
+
+func combined(l *lex) (*Entry, error) {
 	e, err := common(l)
 	if err != nil {
 		return nil, err
@@ -258,13 +322,70 @@ func Combined(line string) (*Entry, error) {
 		return nil, err
 	}
 	e.UserAgent = useragent.Parse(uas)
+	e.HasUserAgent = true
 
 	return e, nil
 }
 
-type ExtendedDirective struct {
+// A Parser parses a log line containing a log entry in a particular format.
+// Parsers for formats with directives return a nil Entry, and no error,
+// for directive lines.
+type Parser func(line string) (*Entry, error)
+
+// A Format describes one of the log formats that can be parsed by this
+// package.
+type Format struct {
+	// The name of the format, e.g. "common".
+	Name string
+	// NewParser returns a Parser for a single log.
+	NewParser func() Parser
+}
+
+// The formats are listed from the most specific to the least specific,
+// as a line in a specific format may also parse as a less specific one.
+var formats = []*Format{
+	{"extended", func() Parser { return new(ExtendedDirective).Extended }},
+	{"json", func() Parser { return NewJSON(&DefaultJSONMapping) }},
+	{"combined", func() Parser { return Combined }},
+	{"common", func() Parser { return Common }},
 }
 
-func (x *ExtendedDirective) Extended(line string) *Entry {
+// Formats returns all the log formats known to this package.
+func Formats() []*Format {
+	return formats
+}
+
+// LookupFormat returns the log format with the given name, or nil if
+// there is no such format.
+func LookupFormat(name string) *Format {
+	for _, f := range formats {
+		if f.Name == name {
+			return f
+		}
+	}
 	return nil
 }
+
+// Detect returns the format which can parse the most of the given lines,
+// or nil if no format can parse any of them. Directive lines count as
+// parsed. If more than one format parses the same number of lines, the
+// most specific one is returned.
+func Detect(lines []string) *Format {
+	var best *Format
+	bestParsed := 0
+
+	for _, f := range formats {
+		parse := f.NewParser()
+		parsed := 0
+		for _, line := range lines {
+			if _, err := parse(line); err == nil {
+				parsed++
+			}
+		}
+		if parsed > bestParsed {
+			best = f
+			bestParsed = parsed
+		}
+	}
+	return best
+}
@@ -68,3 +68,134 @@ func ExampleCombined() {
 	//Firefox
 	//GNU/Linux
 }
+
+func ExampleDetect() {
+	f := Detect([]string{
+		`:: - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+		`:: - xojoc [10/Feb/2015:13:55:37 -0700] "GET /index.html HTTP/1.0" 200 512`,
+	})
+	fmt.Println(f.Name)
+
+	f = Detect([]string{
+		`:: - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://xojoc.pw" "Mozilla/5.0 (X11; Linux i686; rv:38.0) Gecko/20100101 Firefox/38.0"`,
+		`this line is not in any format`,
+	})
+	fmt.Println(f.Name)
+	//Output:common
+	//combined
+}
+
+func ExampleExtendedDirective_Extended() {
+	x := &ExtendedDirective{}
+	for _, line := range []string{
+		`#Software: Microsoft Internet Information Services 10.0`,
+		`#Version: 1.0`,
+		`#Date: 2017-06-01 00:00:00`,
+		`#Fields: date time c-ip cs-method cs-uri-stem cs-uri-query sc-status sc-bytes time-taken cs(User-Agent) cs(Referer)`,
+		`2017-06-01 13:55:36 10.0.0.1 GET /apache_pb.gif a=1 200 2326 15 Mozilla/5.0+(X11;+Linux+i686;+rv:38.0)+Gecko/20100101+Firefox/38.0 http://xojoc.pw`,
+	} {
+		l, err := x.Extended(line)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if l == nil {
+			continue
+		}
+		fmt.Println(l.Host)
+		fmt.Println(l.Time)
+		fmt.Println(l.Request.Method, l.Request.URL)
+		fmt.Println(l.Status)
+		fmt.Println(l.Bytes)
+		fmt.Println(l.Duration)
+		fmt.Println(l.Referer)
+		fmt.Println(l.UserAgent.Name)
+	}
+	//Output:10.0.0.1
+	//2017-06-01 13:55:36 +0000 UTC
+	//GET /apache_pb.gif?a=1
+	//200
+	//2326
+	//15ms
+	//http://xojoc.pw
+	//Firefox
+}
+
+func ExampleCompileApache() {
+	parse, err := CompileApache(`%h %l %u %t "%r" %>s %b %D "%{Referer}i" "%{User-Agent}i" %v`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := parse(`:: - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 1520 "http://xojoc.pw" "Mozilla/5.0 (X11; Linux i686; rv:38.0) Gecko/20100101 Firefox/38.0" www.xojoc.pw`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(l)
+	fmt.Println(l.Duration)
+	fmt.Println(l.Extra["%v"])
+	//Output::: - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://xojoc.pw" "Mozilla/5.0 (X11; Linux i686; rv:38.0) Gecko/20100101 Firefox/38.0"
+	//1.52ms
+	//www.xojoc.pw
+}
+
+func ExampleCompileApache_requestParts() {
+	// Apache's own definition of %r
+	parse, err := CompileApache(`%h %l %u %t "%m %U%q %H" %>s %b`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, line := range []string{
+		`10.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /search?q=logs HTTP/1.1" 200 2326`,
+		`10.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`,
+	} {
+		l, err := parse(line)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(l.Request.Method, l.Request.URL, l.Request.Proto)
+	}
+	//Output:GET /search?q=logs HTTP/1.1
+	//GET /apache_pb.gif HTTP/1.1
+}
+
+func ExampleCompileNginx() {
+	parse, err := CompileNginx(`log_format timed '$remote_addr - $remote_user [$time_local] "$request" '
+                     '$status $body_bytes_sent "$http_referer" "$http_user_agent" '
+                     '$request_time $upstream_response_time $upstream_cache_status $host';`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := parse(`10.0.0.1 - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://xojoc.pw" "Mozilla/5.0 (X11; Linux i686; rv:38.0) Gecko/20100101 Firefox/38.0" 0.125 0.120 HIT www.xojoc.pw`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(l)
+	fmt.Println(l.Duration)
+	fmt.Println(l.Extra["upstream_response_time"])
+	fmt.Println(l.Extra["upstream_cache_status"])
+	fmt.Println(l.Extra["host"])
+	//Output:10.0.0.1 - xojoc [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://xojoc.pw" "Mozilla/5.0 (X11; Linux i686; rv:38.0) Gecko/20100101 Firefox/38.0"
+	//125ms
+	//0.120
+	//HIT
+	//www.xojoc.pw
+}
+
+func ExampleNewJSON() {
+	m, err := ParseJSONMapping("host=client.ip,time=time,time_layout=2006-01-02T15:04:05Z07:00,uri=path,duration=latency,duration_unit=ms")
+	if err != nil {
+		log.Fatal(err)
+	}
+	parse := NewJSON(m)
+	l, err := parse(`{"time":"2015-02-10T13:55:36-07:00","client":{"ip":"10.0.0.1","port":4312},"request":{"method":"GET","proto":"HTTP/1.1"},"path":"/apache_pb.gif","status":200,"size":2326,"latency":12.5,"router":"web"}`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(l)
+	fmt.Println(l.Duration)
+	fmt.Println(l.Extra["client.port"])
+	fmt.Println(l.Extra["router"])
+	//Output:10.0.0.1 - - [10/Feb/2015:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 - -
+	//12.5ms
+	//4312
+	//web
+}
@@ -0,0 +1,180 @@
+/* Copyright (C) 2015 by Alexandru Cojocaru */
+
+/* This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package logparse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompileNginx compiles an nginx log_format, as described in
+// https://nginx.org/en/docs/http/ngx_http_log_module.html#log_format, into
+// a Parser for logs written with that format. The format can be given
+// either as the format string itself, or as the whole log_format directive
+// from nginx.conf, e.g.:
+//
+//	log_format timed '$remote_addr - $remote_user [$time_local] '
+//	                 '"$request" $status $body_bytes_sent $request_time';
+//
+// The variables mapped onto Entry are:
+//
+//	$remote_addr $remote_user $time_local $time_iso8601 $msec $request
+//	$request_method $request_uri $uri $args $server_protocol $status
+//	$body_bytes_sent $request_time $http_referer $http_user_agent
+//
+// The values of any other variables, such as $upstream_response_time,
+// $upstream_cache_status and $host, are kept in Entry.Extra, keyed by the
+// variable name without the '$'.
+func CompileNginx(logFormat string) (Parser, error) {
+	s, err := nginxFormatString(logFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &template{}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			t.addLiteral(s)
+			break
+		}
+		t.addLiteral(s[:i])
+		s = s[i+1:]
+
+		var name string
+		if strings.HasPrefix(s, "{") {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable \"${%s\"", s)
+			}
+			name = s[1:end]
+			s = s[end+1:]
+		} else {
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+			})
+			if end < 0 {
+				end = len(s)
+			}
+			name = s[:end]
+			s = s[end:]
+		}
+		if name == "" {
+			// A '$' which does not start a variable
+			t.addLiteral("$")
+			continue
+		}
+
+		if err := t.addField(nginxVariable(name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.finish(); err != nil {
+		return nil, err
+	}
+	return t.parse, nil
+}
+
+// If the format is a whole log_format directive, return just its format
+// string, which may be split across several quoted strings.
+func nginxFormatString(directive string) (string, error) {
+	s := strings.TrimSpace(directive)
+	if !strings.HasPrefix(s, "log_format ") && !strings.HasPrefix(s, "log_format\t") {
+		return directive, nil
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, ";"))
+	words := strings.Fields(s)
+
+	// Skip "log_format", the name, and the optional escape parameter
+	skip := 2
+	if len(words) > skip && strings.HasPrefix(words[skip], "escape=") {
+		skip++
+	}
+	if len(words) <= skip {
+		return "", fmt.Errorf("the log_format directive has no format")
+	}
+	for _, word := range words[:skip] {
+		s = strings.TrimSpace(strings.TrimPrefix(s, word))
+	}
+
+	if s[0] != '\'' && s[0] != '"' {
+		// A format without quotes cannot have spaces
+		return s, nil
+	}
+
+	var format string
+	for s != "" {
+		quote := s[0]
+		if quote != '\'' && quote != '"' {
+			return "", fmt.Errorf("expected a quoted string in log_format, but got %q", s)
+		}
+		end := strings.IndexByte(s[1:], quote)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string in log_format: %s", s)
+		}
+		format += s[1 : end+1]
+		s = strings.TrimSpace(s[end+2:])
+	}
+	return format, nil
+}
+
+func nginxVariable(name string) *templateField {
+	f := &templateField{name: name, set: setExtra}
+
+	switch name {
+	case "remote_addr":
+		f.set = setHost
+	case "remote_user":
+		f.set = setUser
+	case "time_local":
+		f.set = setTime
+	case "time_iso8601":
+		f.set = setISO8601Time
+	case "msec":
+		f.set = setEpochTime(time.Second)
+	case "request":
+		f.set = setRequestLine
+	case "request_method":
+		f.set = setMethod
+	case "request_uri":
+		f.set = setURI
+	case "uri", "document_uri":
+		f.set = setPath
+	case "args", "query_string":
+		f.set = setQuery
+	case "server_protocol":
+		f.set = setProto
+	case "status":
+		f.set = setStatus
+	case "body_bytes_sent":
+		f.set = setBytes
+	case "request_time":
+		f.set = setDuration(time.Second)
+	case "http_referer":
+		f.set = setReferer
+	case "http_user_agent":
+		f.set = setUserAgent
+		f.userAgent = true
+	}
+	return f
+}
+
+func setISO8601Time(b *entryBuilder, name, value string) error {
+	var err error
+	b.e.Time, err = time.Parse(time.RFC3339, value)
+	return err
+}
@@ -0,0 +1,259 @@
+/* Copyright (C) 2015 by Alexandru Cojocaru */
+
+/* This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package logparse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A template is a compiled custom log format, like an Apache LogFormat or
+// an nginx log_format. It is a sequence of fields, each of which is
+// surrounded by literal text.
+type template struct {
+	// literals[i] comes before fields[i]; the final literal follows the
+	// last field.
+	literals []string
+	fields   []*templateField
+}
+
+type templateField struct {
+	// The field as written in the format; this is the key used in
+	// Entry.Extra.
+	name string
+	// Values are quoted (by the surrounding literals), and may contain
+	// backslash-escaped characters.
+	quoted bool
+	// If not empty, the value is wrapped in open and close, as in the
+	// "[date]" of an Apache %t.
+	open, close string
+	// If not empty, the value is either empty or starts with this, as the
+	// "?query" of an Apache %q, so the field can directly follow another
+	// one, which ends where this starts.
+	prefix string
+	// The value is the user agent of the client.
+	userAgent bool
+	// Sets the value in the entry; "-" values, which mean that there is
+	// no value, are not set.
+	set func(b *entryBuilder, name, value string) error
+}
+
+// Add literal text to the end of the template
+func (t *template) addLiteral(s string) {
+	if len(t.literals) == len(t.fields) {
+		t.literals = append(t.literals, s)
+	} else {
+		t.literals[len(t.literals)-1] += s
+	}
+}
+
+// Add a field to the end of the template
+func (t *template) addField(f *templateField) error {
+	if len(t.literals) == len(t.fields) {
+		t.literals = append(t.literals, "")
+	}
+	if len(t.fields) > 0 && t.literals[len(t.literals)-1] == "" && t.fields[len(t.fields)-1].close == "" && f.open == "" && f.prefix == "" {
+		return fmt.Errorf("%s must be separated from %s", f.name, t.fields[len(t.fields)-1].name)
+	}
+	t.fields = append(t.fields, f)
+	return nil
+}
+
+// Finish building the template, and check that the quoted fields are known.
+func (t *template) finish() error {
+	if len(t.fields) == 0 {
+		return fmt.Errorf("the format has no fields")
+	}
+	t.addLiteral("")
+	for i, f := range t.fields {
+		if f.open == "" && strings.HasSuffix(t.literals[i], "\"") && strings.HasPrefix(t.literals[i+1], "\"") {
+			f.quoted = true
+		}
+	}
+	return nil
+}
+
+func (t *template) parse(line string) (*Entry, error) {
+	l := newLex(line)
+	e, err := t.entry(l)
+	if err != nil {
+		return nil, newSyntaxError(l, err)
+	}
+	return e, nil
+}
+
+func (t *template) entry(l *lex) (*Entry, error) {
+	b := newEntryBuilder()
+
+	if !l.match(t.literals[0]) {
+		return nil, fmt.Errorf("expected %q", t.literals[0])
+	}
+	for i, f := range t.fields {
+		if f.userAgent {
+			b.e.HasUserAgent = true
+		}
+		next := t.literals[i+1]
+		var value string
+		var err error
+		if next == "" && i+1 < len(t.fields) && t.fields[i+1].prefix != "" {
+			value, err = f.valueBefore(l, t.fields[i+1].prefix, t.literals[i+2])
+		} else {
+			value, err = f.value(l, next)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value != "-" {
+			if err := f.set(b, f.name, value); err != nil {
+				return nil, fmt.Errorf("%s: %s", f.name, err)
+			}
+		}
+		if !l.match(next) {
+			return nil, fmt.Errorf("expected %q after %s", next, f.name)
+		}
+	}
+	// Like Common, any text after the last field is ignored
+
+	return b.finish()
+}
+
+// Read the value of a field, which ends where the next literal text starts.
+func (f *templateField) value(l *lex, next string) (string, error) {
+	if f.open != "" {
+		if !l.match(f.open) {
+			return "", fmt.Errorf("%s: expected %q", f.name, f.open)
+		}
+		v, ok := l.span(f.close)
+		if !ok {
+			return "", fmt.Errorf("%s: cannot find %q", f.name, f.close)
+		}
+		return v, nil
+	}
+
+	rest := l.s[l.p:]
+	if next == "" {
+		// The last field takes the rest of the line
+		l.p = len(l.s)
+		return rest, nil
+	}
+
+	if f.quoted {
+		// Find the closing quote, skipping escaped characters
+		for i := 0; i < len(rest); i++ {
+			if rest[i] == '\\' {
+				i++
+			} else if strings.HasPrefix(rest[i:], next) {
+				l.p += i
+				return unescape(rest[:i]), nil
+			}
+		}
+	} else if i := strings.Index(rest, next); i >= 0 {
+		l.p += i
+		return rest[:i], nil
+	}
+	return "", fmt.Errorf("%s: cannot find %q", f.name, next)
+}
+
+// Read the value of a field which is directly followed by a field with a
+// prefix: it ends where the prefix starts, or if the following field is
+// empty, where the literal text after that field starts.
+func (f *templateField) valueBefore(l *lex, prefix string, after string) (string, error) {
+	rest := l.s[l.p:]
+	end := len(rest)
+	if after != "" {
+		end = strings.Index(rest, after)
+		if end < 0 {
+			return "", fmt.Errorf("%s: cannot find %q", f.name, after)
+		}
+	}
+	if i := strings.Index(rest[:end], prefix); i >= 0 {
+		end = i
+	}
+	l.p += end
+	return rest[:end], nil
+}
+
+// Remove the backslashes which escape characters in quoted values. Both
+// Apache and nginx write unprintable characters, and nginx writes double
+// quotes, as \xHH.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var u []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'x' && i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					u = append(u, byte(b))
+					i += 2
+					continue
+				}
+			}
+		}
+		u = append(u, s[i])
+	}
+	return string(u)
+}
+
+// An entryBuilder collects the parts of an Entry as the fields of a custom
+// format are parsed, as the request may come from more than one field.
+type entryBuilder struct {
+	e           *Entry
+	requestLine string
+	method      string
+	uri         string
+	path        string
+	query       string
+	proto       string
+}
+
+func newEntryBuilder() *entryBuilder {
+	return &entryBuilder{
+		e: &Entry{Status: -1, Duration: -1},
+	}
+}
+
+func (b *entryBuilder) setExtra(name, value string) {
+	if b.e.Extra == nil {
+		b.e.Extra = make(map[string]string)
+	}
+	b.e.Extra[name] = value
+}
+
+func (b *entryBuilder) finish() (*Entry, error) {
+	var err error
+	if b.requestLine != "" {
+		b.e.Request, err = parseRequestLine(b.requestLine)
+	} else {
+		uri := b.uri
+		if uri == "" && b.path != "" {
+			uri = b.path
+			if b.query != "" {
+				uri += "?" + strings.TrimPrefix(b.query, "?")
+			}
+		}
+		if uri != "" {
+			b.e.Request, err = newRequest(b.method, uri, b.proto)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.e, nil
+}